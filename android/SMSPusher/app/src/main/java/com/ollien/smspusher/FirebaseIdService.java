@@ -70,9 +70,8 @@ public class FirebaseIdService extends FirebaseInstanceIdService {
 	 * @param resListener A response listener for the server's response.
 	 * @param errorListener An error listener for the server's response.
 	 */
-	protected static void updateTokenOnServer(SharedPreferences prefs, RequestQueue queue, Response.Listener<String> resListener, Response.ErrorListener errorListener) {
+	protected static void updateTokenOnServer(final SharedPreferences prefs, RequestQueue queue, Response.Listener<String> resListener, Response.ErrorListener errorListener) {
 		String hostURL = prefs.getString(MainActivity.HOST_URL_PREFS_KEY, "");
-		String sessionID = prefs.getString(MainActivity.SESSION_ID_PREFS_KEY, "");
 		String deviceID = prefs.getString(MainActivity.DEVICE_ID_PREFS_KEY, "");
 		String token = prefs.getString(MainActivity.FCM_TOKEN_PREFS_KEY, "");
 		if (hostURL.equals("")) {
@@ -90,12 +89,16 @@ public class FirebaseIdService extends FirebaseInstanceIdService {
 			final HashMap<String, String> reqMap = new HashMap<>();
 			reqMap.put("fcm_id", token);
 			reqMap.put("device_id", deviceID);
-			reqMap.put("session_id", sessionID);
 			StringRequest req = new StringRequest(Request.Method.POST, updateURL.toString(),  resListener, errorListener)
 			{
 				protected Map<String, String> getParams() {
 					return reqMap;
 				}
+
+				@Override
+				public Map<String, String> getHeaders() {
+					return MainActivity.getDeviceAuthHeaders(prefs);
+				}
 			};
 			queue.add(req);
 		} catch (MalformedURLException e) {
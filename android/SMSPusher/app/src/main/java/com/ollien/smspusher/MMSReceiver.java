@@ -56,7 +56,7 @@ public class MMSReceiver extends BroadcastReceiver {
 	private static final String BLOCK_ID_KEY = "block_id";
 	private static final String ILLEGAL_NO_HOST_MESSAGE = "No host has been set";
 	private static final String ILLEGAL_NO_ID_MESSAGE = "No device id has been set";
-	private static final String ILLEGAL_NO_SESSION_MESSAGE = "No session id has been set";
+	private static final String ILLEGAL_NO_TOKEN_MESSAGE = "No device token has been set";
 
 	/**
 	 * Sends different MMS parts upstream
@@ -86,9 +86,9 @@ public class MMSReceiver extends BroadcastReceiver {
 		 * @param context The context in which the receiver is running.
 		 */
 		private void send(Context context) {
-			SharedPreferences prefs = context.getSharedPreferences(MainActivity.PREFS_KEY, Context.MODE_PRIVATE);
+			final SharedPreferences prefs = context.getSharedPreferences(MainActivity.PREFS_KEY, Context.MODE_PRIVATE);
 			String host = prefs.getString(MainActivity.HOST_URL_PREFS_KEY, "");
-			String sessionId = prefs.getString(MainActivity.SESSION_ID_PREFS_KEY, "");
+			final String deviceToken = prefs.getString(MainActivity.DEVICE_TOKEN_PREFS_KEY, "");
 			final String deviceId = prefs.getString(MainActivity.DEVICE_ID_PREFS_KEY, "");
 			if (host.length() == 0) {
 				Log.wtf("SMSPusher", ILLEGAL_NO_HOST_MESSAGE);
@@ -96,8 +96,8 @@ public class MMSReceiver extends BroadcastReceiver {
 			if (deviceId.length() == 0) {
 				Log.wtf("SMSPusher", ILLEGAL_NO_ID_MESSAGE);
 			}
-			if (sessionId.length() == 0) {
-				Log.wtf("SMSPusher", ILLEGAL_NO_SESSION_MESSAGE);
+			if (deviceToken.length() == 0) {
+				Log.wtf("SMSPusher", ILLEGAL_NO_TOKEN_MESSAGE);
 			}
 			try {
 				final URL hostUrl = new URL(host);
@@ -130,10 +130,14 @@ public class MMSReceiver extends BroadcastReceiver {
 								Map<String, String> paramsMap = new HashMap<>();
 								paramsMap.put("device_id", deviceId);
 								paramsMap.put("data", part);
-								paramsMap.put("session_id", sessionId);
 								paramsMap.put("block_id", blockId);
 								return paramsMap;
 							}
+
+							@Override
+							public Map<String, String> getHeaders() {
+								return MainActivity.getDeviceAuthHeaders(prefs);
+							}
 						};
 						reqQueue.add(subsequentReq);
 					}
@@ -142,9 +146,13 @@ public class MMSReceiver extends BroadcastReceiver {
 						Map<String, String> paramsMap = new HashMap<>();
 						paramsMap.put("device_id", deviceId);
 						paramsMap.put("data", firstPart);
-						paramsMap.put("session_id", sessionId);
 						return paramsMap;
 					}
+
+					@Override
+					public Map<String, String> getHeaders() {
+						return MainActivity.getDeviceAuthHeaders(prefs);
+					}
 				};
 
 				reqQueue.add(req);
@@ -39,6 +39,7 @@ public class MainActivity extends AppCompatActivity {
 	protected static final String PREFS_KEY = "SMSPusherPrefs";
 	protected static final String SESSION_ID_PREFS_KEY = "session_id";
 	protected static final String DEVICE_ID_PREFS_KEY = "device_id";
+	protected static final String DEVICE_TOKEN_PREFS_KEY = "device_token";
 	protected static final String HOST_URL_PREFS_KEY = "host_url";
 	protected static final String FCM_TOKEN_PREFS_KEY = "fcm_token";
 
@@ -70,6 +71,7 @@ public class MainActivity extends AppCompatActivity {
 		prefs = getSharedPreferences(PREFS_KEY, MODE_PRIVATE);
 		prefsEditor = prefs.edit();
 		updateDeviceIDDisplay();
+		upgradeToDeviceToken();
 	}
 
 	/**
@@ -147,8 +149,7 @@ public class MainActivity extends AppCompatActivity {
 	 */
 	private void registerDevice(final URL host, final Response.Listener<String> resListener, final Response.ErrorListener errorListener) throws MalformedURLException {
 		final URL registerUrl = new URL(host, "/register_device");
-		final HashMap<String, String> authMap = new HashMap<String, String>();
-		authMap.put("session_id", prefs.getString(SESSION_ID_PREFS_KEY, ""));
+		final Map<String, String> authHeaders = getSessionAuthHeaders(prefs.getString(SESSION_ID_PREFS_KEY, ""));
 		StringRequest req = new StringRequest(Request.Method.POST, registerUrl.toString(), new Response.Listener<String>() {
 			@Override
 			public void onResponse(String response) {
@@ -157,8 +158,11 @@ public class MainActivity extends AppCompatActivity {
 					resJSON = new JSONObject(response);
 					String deviceID = resJSON.getString("device_id");
 					prefsEditor.putString(DEVICE_ID_PREFS_KEY, deviceID);
+					prefsEditor.putString(DEVICE_TOKEN_PREFS_KEY, resJSON.getString("device_token"));
 					prefsEditor.putString(HOST_URL_PREFS_KEY, host.toString());
 					prefsEditor.apply();
+					//The device acts as itself from now on, so the user's session is no longer needed.
+					logout(host);
 					if (resListener != null) {
 						resListener.onResponse(deviceID);
 					}
@@ -171,8 +175,9 @@ public class MainActivity extends AppCompatActivity {
 				}
 			}
 		}, errorListener) {
-			protected Map<String, String> getParams() {
-				return authMap;
+			@Override
+			public Map<String, String> getHeaders() {
+				return authHeaders;
 			}
 		};
 		queue.add(req);
@@ -209,6 +214,8 @@ public class MainActivity extends AppCompatActivity {
 
 					prefsEditor.putString(SESSION_ID_PREFS_KEY, sessionID);
 					prefsEditor.apply();
+					//The session is sent as a header from now on; the server rejects requests that send the cookie too.
+					cookieManager.getCookieStore().removeAll();
 					if (resListener != null) {
 						resListener.onResponse(sessionID);
 					}
@@ -228,6 +235,113 @@ public class MainActivity extends AppCompatActivity {
 		queue.add(req);
 	}
 
+	/**
+	 * Ends the user's session on the server, and forgets it.
+	 *
+	 * The session is forgotten even if the server can't be reached, as it will expire on its own.
+	 * @param host The host the session was made on.
+	 */
+	private void logout(URL host) {
+		final Map<String, String> authHeaders = getSessionAuthHeaders(prefs.getString(SESSION_ID_PREFS_KEY, ""));
+		prefsEditor.remove(SESSION_ID_PREFS_KEY);
+		prefsEditor.apply();
+		cookieManager.getCookieStore().removeAll();
+		try {
+			final URL logoutURL = new URL(host, "/logout");
+			StringRequest req = new StringRequest(Request.Method.POST, logoutURL.toString(), new Response.Listener<String>() {
+				@Override
+				public void onResponse(String response) {
+				}
+			}, new Response.ErrorListener() {
+				@Override
+				public void onErrorResponse(VolleyError e) {
+					Log.e("SMSPusher", e.toString());
+				}
+			}) {
+				@Override
+				public Map<String, String> getHeaders() {
+					return authHeaders;
+				}
+			};
+			queue.add(req);
+		}
+		catch (MalformedURLException e) {
+			Log.e("SMSPusher", e.toString());
+		}
+	}
+
+	/**
+	 * Gets a device token for a device that was registered before the server issued them, and then logs out the session it used until now.
+	 *
+	 * Does nothing if the device already has a token, or was never registered.
+	 */
+	private void upgradeToDeviceToken() {
+		String hostURL = prefs.getString(HOST_URL_PREFS_KEY, "");
+		String deviceID = prefs.getString(DEVICE_ID_PREFS_KEY, "");
+		String sessionID = prefs.getString(SESSION_ID_PREFS_KEY, "");
+		if (hostURL.equals("") || deviceID.equals("") || sessionID.equals("") || !prefs.getString(DEVICE_TOKEN_PREFS_KEY, "").equals("")) {
+			return;
+		}
+
+		try {
+			final URL host = new URL(hostURL);
+			final URL tokenURL = new URL(host, "/devices/" + deviceID + "/token");
+			final Map<String, String> authHeaders = getSessionAuthHeaders(sessionID);
+			StringRequest req = new StringRequest(Request.Method.POST, tokenURL.toString(), new Response.Listener<String>() {
+				@Override
+				public void onResponse(String response) {
+					try {
+						JSONObject resJSON = new JSONObject(response);
+						prefsEditor.putString(DEVICE_TOKEN_PREFS_KEY, resJSON.getString("device_token"));
+						prefsEditor.apply();
+						logout(host);
+					}
+					catch (JSONException e) {
+						Log.e("SMSPusher", e.toString());
+					}
+				}
+			}, new Response.ErrorListener() {
+				@Override
+				public void onErrorResponse(VolleyError e) {
+					Log.e("SMSPusher", e.toString());
+				}
+			}) {
+				@Override
+				public Map<String, String> getHeaders() {
+					return authHeaders;
+				}
+			};
+			queue.add(req);
+		}
+		catch (MalformedURLException e) {
+			Log.e("SMSPusher", e.toString());
+		}
+	}
+
+	/**
+	 * Gets the headers that authenticate a request with the user's session.
+	 * @param sessionID The id of the session.
+	 * @return The headers to send with the request.
+	 */
+	private static Map<String, String> getSessionAuthHeaders(String sessionID) {
+		Map<String, String> headers = new HashMap<>();
+		headers.put("X-Session-ID", sessionID);
+
+		return headers;
+	}
+
+	/**
+	 * Gets the headers that authenticate a request as this device.
+	 * @param prefs The app's SharedPreferences
+	 * @return The headers to send with the request.
+	 */
+	protected static Map<String, String> getDeviceAuthHeaders(SharedPreferences prefs) {
+		Map<String, String> headers = new HashMap<>();
+		headers.put("Authorization", "Bearer " + prefs.getString(DEVICE_TOKEN_PREFS_KEY, ""));
+
+		return headers;
+	}
+
 	/**
 	 * Updates the displayed device ID.
 	 */
@@ -2,13 +2,23 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"sync"
+	"time"
 )
 
 const configPath = "config.json"
 
+const (
+	//defaultShutdownDeadline is how long the server has to shut down if no deadline is configured
+	defaultShutdownDeadline = 30 * time.Second
+	//defaultSessionTimeout is how long a session may go unused before it expires, if no timeout is configured
+	defaultSessionTimeout = 30 * 24 * time.Hour
+)
+
 var config Config
 var configMux sync.Mutex
 
@@ -18,6 +28,10 @@ type Config struct {
 	XMPP     XMPPConfig     `json:"xmpp"`
 	MMS      MMSConfig      `json:"mms"`
 	Web      WebConfig      `json:"web"`
+	Phone    PhoneConfig    `json:"phone"`
+	//Downstream selects how messages are sent to devices. Upstream messages are only ever received over XMPP.
+	Downstream DownstreamConfig `json:"downstream"`
+	Shutdown   ShutdownConfig   `json:"shutdown"`
 }
 
 //DatabaseConfig represents the config for the database
@@ -25,10 +39,69 @@ type DatabaseConfig struct {
 	URI string `json:"uri"`
 }
 
+const (
+	//ProductionEnvironment is the XMPP environment for FCM's production endpoint
+	ProductionEnvironment = "production"
+	//DevelopmentEnvironment is the XMPP environment for FCM's pre-production endpoint. If no environment is given, this is used.
+	DevelopmentEnvironment = "development"
+)
+
 //XMPPConfig represents the config for the XMPP server
 type XMPPConfig struct {
 	ServerKey string `json:"server_key"`
 	SenderID  string `json:"sender_id"`
+	//Connections is the number of connections to keep open to FCM. Each connection may only have 100 messages awaiting an ACK at once. Defaults to one.
+	Connections int `json:"connections"`
+	//Disabled stops any XMPP connections from being made, in which case no upstream messages will be received. Downstream messages must be sent over HTTP.
+	Disabled bool `json:"disabled"`
+	//Environment is either ProductionEnvironment or DevelopmentEnvironment, and determines the port that is connected to by default.
+	Environment string `json:"environment"`
+	//Host and Port override the FCM endpoint, such as to connect to a local server for testing. Either one that is unset falls back to FCM's.
+	Host  string        `json:"host"`
+	Port  int           `json:"port"`
+	TLS   XMPPTLSConfig `json:"tls"`
+	Debug bool          `json:"debug"`
+}
+
+//XMPPTLSConfig represents the TLS settings for the connection to the XMPP server
+type XMPPTLSConfig struct {
+	//CAFile is the path to a PEM encoded certificate authority to trust instead of the system's.
+	CAFile string `json:"ca_file"`
+	//ServerName is the name to verify the server's certificate against, if it differs from the host.
+	ServerName string `json:"server_name"`
+	//InsecureSkipVerify disables all certificate verification. This should only ever be used for local testing.
+	InsecureSkipVerify bool `json:"insecure_skip_verify"`
+}
+
+const (
+	//XMPPDownstream sends downstream messages over the FCM XMPP connection. If no downstream transport is given, this is used.
+	XMPPDownstream = "xmpp"
+	//HTTPDownstream sends downstream messages with the FCM HTTP v1 API
+	HTTPDownstream = "http_v1"
+)
+
+//DownstreamConfig represents the config for sending messages to devices
+type DownstreamConfig struct {
+	//Transport is either XMPPDownstream or HTTPDownstream
+	Transport string        `json:"transport"`
+	HTTP      FCMHTTPConfig `json:"http_v1"`
+}
+
+//FCMHTTPConfig represents the config for the FCM HTTP v1 API
+type FCMHTTPConfig struct {
+	//ServiceAccountFile is the path to the JSON key of the service account to authorize with
+	ServiceAccountFile string `json:"service_account_file"`
+	//ProjectID is the Firebase project to send messages with. If unset, the service account's project is used.
+	ProjectID string `json:"project_id"`
+	//Endpoint and TokenURL override Google's endpoints, such as to send to a local server for testing. If unset, the FCM endpoint, and the service account's token URI, are used.
+	Endpoint string `json:"endpoint"`
+	TokenURL string `json:"token_url"`
+}
+
+//ShutdownConfig represents the config for shutting down the server
+type ShutdownConfig struct {
+	//DeadlineSeconds is how long the server has to shut down gracefully once it is told to stop. Anything left unfinished by then is abandoned.
+	DeadlineSeconds int `json:"deadline_seconds"`
 }
 
 //MMSConfig represents the config for the MMS portion of the FCM XMPP server
@@ -40,6 +113,34 @@ type MMSConfig struct {
 type WebConfig struct {
 	ListenAddress string `json:"listen_address"`
 	Port          int    `json:"port"`
+	//SessionTimeoutSeconds is how long a session may go unused before it expires. Every use of a session pushes its expiry back.
+	SessionTimeoutSeconds int          `json:"session_timeout_seconds"`
+	Cookie                CookieConfig `json:"cookie"`
+}
+
+const (
+	//LaxSameSite only sends the session cookie on cross-site requests that navigate to the server. If no same site policy is given, this is used.
+	LaxSameSite = "lax"
+	//StrictSameSite never sends the session cookie on cross-site requests
+	StrictSameSite = "strict"
+	//NoneSameSite sends the session cookie on all cross-site requests. The cookie must be secure to use this.
+	NoneSameSite = "none"
+)
+
+//CookieConfig represents the config for the session cookie. The cookie is always HttpOnly.
+type CookieConfig struct {
+	//Secure should be set whenever the server is reached over HTTPS, such that the cookie is never sent in the clear.
+	Secure   bool   `json:"secure"`
+	SameSite string `json:"same_site"`
+	Domain   string `json:"domain"`
+	//Path defaults to "/", such that the cookie is sent to every route.
+	Path string `json:"path"`
+}
+
+//PhoneConfig represents the config for handling phone numbers
+type PhoneConfig struct {
+	//DefaultRegion is the ISO 3166-1 alpha-2 code of the region that numbers without a country code are assumed to be in.
+	DefaultRegion string `json:"default_region"`
 }
 
 //ParseConfig parses the default configPath into a Config
@@ -79,6 +180,87 @@ func GetConfig() (Config, error) {
 	return config, nil
 }
 
+//IsProduction returns whether or not the XMPP config is for FCM's production endpoint.
+//Returns an error if the environment is not known.
+func (xmppConfig XMPPConfig) IsProduction() (bool, error) {
+	switch xmppConfig.Environment {
+	case ProductionEnvironment:
+		return true, nil
+	case DevelopmentEnvironment, "":
+		return false, nil
+	default:
+		return false, fmt.Errorf("unknown xmpp environment %q", xmppConfig.Environment)
+	}
+}
+
+//GetConnectionCount gets the number of connections to keep open to FCM
+func (xmppConfig XMPPConfig) GetConnectionCount() int {
+	if xmppConfig.Connections < 1 {
+		return 1
+	}
+
+	return xmppConfig.Connections
+}
+
+//UsesHTTP returns whether or not downstream messages are sent with the HTTP v1 API.
+//Returns an error if the transport is not known.
+func (downstreamConfig DownstreamConfig) UsesHTTP() (bool, error) {
+	switch downstreamConfig.Transport {
+	case HTTPDownstream:
+		return true, nil
+	case XMPPDownstream, "":
+		return false, nil
+	default:
+		return false, fmt.Errorf("unknown downstream transport %q", downstreamConfig.Transport)
+	}
+}
+
+//GetSessionTimeout gets how long a session may go unused before it expires
+func (webConfig WebConfig) GetSessionTimeout() time.Duration {
+	if webConfig.SessionTimeoutSeconds < 1 {
+		return defaultSessionTimeout
+	}
+
+	return time.Duration(webConfig.SessionTimeoutSeconds) * time.Second
+}
+
+//GetSameSite gets the SameSite attribute of the session cookie.
+//Returns an error if the same site policy is not known, or if it can't be used with the rest of the cookie config.
+func (cookieConfig CookieConfig) GetSameSite() (http.SameSite, error) {
+	switch cookieConfig.SameSite {
+	case LaxSameSite, "":
+		return http.SameSiteLaxMode, nil
+	case StrictSameSite:
+		return http.SameSiteStrictMode, nil
+	case NoneSameSite:
+		if !cookieConfig.Secure {
+			return 0, errors.New("a cookie with a same site policy of none must be secure")
+		}
+
+		return http.SameSiteNoneMode, nil
+	default:
+		return 0, fmt.Errorf("unknown same site policy %q", cookieConfig.SameSite)
+	}
+}
+
+//GetPath gets the path of the session cookie
+func (cookieConfig CookieConfig) GetPath() string {
+	if cookieConfig.Path == "" {
+		return "/"
+	}
+
+	return cookieConfig.Path
+}
+
+//GetDeadline gets how long the server has to shut down gracefully
+func (shutdownConfig ShutdownConfig) GetDeadline() time.Duration {
+	if shutdownConfig.DeadlineSeconds < 1 {
+		return defaultShutdownDeadline
+	}
+
+	return time.Duration(shutdownConfig.DeadlineSeconds) * time.Second
+}
+
 //GetListenAddress combiens the ListenAddress with Port to form a well formed host address
 func (webConfig WebConfig) GetListenAddress() string {
 	return fmt.Sprintf("%s:%d", webConfig.ListenAddress, webConfig.Port)
@@ -3,6 +3,7 @@ package db
 import (
 	"database/sql"
 	"net"
+	"time"
 
 	_ "github.com/lib/pq"
 	"github.com/ollien/sms-pusher/server/config"
@@ -21,6 +22,8 @@ type DatabaseConnection struct {
 	*sql.DB
 	logger *logrus.Logger
 	uri    string
+	//sessionTimeout is how long a session may go unused before it expires
+	sessionTimeout time.Duration
 }
 
 //DatabaseError represents an error that was produced during the running of a databse action
@@ -44,12 +47,103 @@ type Device struct {
 	ID    uuid.UUID
 	FCMID []byte
 	User  User
+	//HasToken is whether or not the device has been issued a token that hasn't been revoked
+	HasToken bool
 }
 
 //Session represents a session for a user
+//A session expires once it has gone unused for the configured session timeout.
 type Session struct {
-	ID   uuid.UUID
-	User User
+	ID         uuid.UUID
+	User       User
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+	//UserAgent and IPAddress are those of the client that created the session
+	UserAgent string
+	IPAddress string
+	//CSRFToken must accompany any request that changes state and is authenticated by the session's cookie
+	CSRFToken string
+}
+
+//PersonalAccessToken represents a token that a user has made to use the API from scripts, without a session.
+//A token may only be used for the actions its scopes allow, and only until it expires.
+type PersonalAccessToken struct {
+	ID        int
+	User      User
+	Name      string
+	Scopes    []string
+	CreatedAt time.Time
+	//LastUsedAt is the zero time if the token has never been used
+	LastUsedAt time.Time
+	ExpiresAt  time.Time
+}
+
+//Message represents a text message that was sent upstream by a device
+type Message struct {
+	ID           int
+	FCMMessageID string
+	DeviceID     uuid.UUID
+	UserID       int
+	ThreadID     int
+	//PhoneNumber and Recipients are normalized to E.164 where possible. RawPhoneNumber and RawRecipients hold them as they were sent to us.
+	PhoneNumber    string
+	RawPhoneNumber string
+	Recipients     []string
+	RawRecipients  []string
+	Body           string
+	BlockID        uuid.NullUUID
+	MMS            bool
+	SentAt         time.Time
+	ReceivedAt     time.Time
+}
+
+//Thread represents a conversation between a user and a set of participants
+type Thread struct {
+	ID            int
+	UserID        int
+	Participants  []string
+	LastMessageID int
+	UpdatedAt     time.Time
+}
+
+//OutboundStatus represents how far along an outbound message is in being sent
+type OutboundStatus string
+
+const (
+	//QueuedStatus indicates that the message has been accepted, but has not been sent to FCM yet
+	QueuedStatus OutboundStatus = "queued"
+	//SentStatus indicates that the message has been sent to FCM, but FCM has not acknowledged it
+	SentStatus OutboundStatus = "sent"
+	//ACKedStatus indicates that FCM has accepted the message
+	ACKedStatus OutboundStatus = "acked"
+	//RetryingStatus indicates that FCM has rejected the message, but it will be sent again
+	RetryingStatus OutboundStatus = "retrying"
+	//NACKedStatus indicates that FCM has rejected the message, and it will not be sent again
+	NACKedStatus OutboundStatus = "nacked"
+	//DeliveredStatus indicates that FCM has delivered the message to the device
+	DeliveredStatus OutboundStatus = "delivered"
+	//FailedStatus indicates that the message could not be sent to FCM at all
+	FailedStatus OutboundStatus = "failed"
+)
+
+//OutboundMessage represents a message that a user has asked one of their devices to send
+type OutboundMessage struct {
+	//ID is the message_id that was given to FCM
+	ID               string
+	DeviceID         uuid.UUID
+	UserID           int
+	PhoneNumber      string
+	RawPhoneNumber   string
+	Body             string
+	Status           OutboundStatus
+	Error            string
+	ErrorDescription string
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+	//Payload is the JSON that is sent to FCM. It is only populated when recording or claiming outbound messages.
+	Payload          []byte
+	DispatchAttempts int
 }
 
 //NewDatabaseConnection intiializes the database connection and returns a DatabaseConnection.
@@ -61,8 +155,9 @@ func NewDatabaseConnection(logger *logrus.Logger) (DatabaseConnection, error) {
 	}
 
 	connection := DatabaseConnection{
-		logger: logger,
-		uri:    appConfig.Database.URI,
+		logger:         logger,
+		uri:            appConfig.Database.URI,
+		sessionTimeout: appConfig.Web.GetSessionTimeout(),
 	}
 
 	return connection, nil
@@ -118,3 +213,14 @@ func (err DatabaseError) Error() string {
 
 	return err.message
 }
+
+//HasScope returns whether or not the token has been granted the given scope
+func (accessToken PersonalAccessToken) HasScope(scope string) bool {
+	for _, grantedScope := range accessToken.Scopes {
+		if grantedScope == scope {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,47 @@
+package migration
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(Up00003, Down00003)
+}
+
+func Up00003(tx *sql.Tx) error {
+	//Create messages table
+	//phone_number is the number of the party that sent the message to the device. recipients is only populated for MMS messages.
+	_, err := tx.Exec("CREATE TABLE messages (" +
+		"id SERIAL PRIMARY KEY," +
+		"fcm_message_id VARCHAR(256)," +
+		"device uuid REFERENCES devices(id)," +
+		"for_user INTEGER REFERENCES users(id)," +
+		"phone_number VARCHAR(32)," +
+		"recipients VARCHAR(32)[]," +
+		"body TEXT," +
+		"block uuid REFERENCES mms_file_blocks(id)," +
+		"mms BOOLEAN NOT NULL DEFAULT FALSE," +
+		"sent_at TIMESTAMP WITH TIME ZONE," +
+		"received_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now());")
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("CREATE INDEX messages_for_user_idx ON messages(for_user, id);")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func Down00003(tx *sql.Tx) error {
+	_, err := tx.Exec("DROP TABLE messages;")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
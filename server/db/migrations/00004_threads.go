@@ -0,0 +1,130 @@
+package migration
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(Up00004, Down00004)
+}
+
+func Up00004(tx *sql.Tx) error {
+	//Create threads table
+	//participants_key is the sorted participant list, joined by commas, so that a participant set can be looked up (and made unique) without comparing arrays.
+	//last_message is not a foreign key, as messages already references threads.
+	_, err := tx.Exec("CREATE TABLE threads (" +
+		"id SERIAL PRIMARY KEY," +
+		"for_user INTEGER REFERENCES users(id)," +
+		"participants VARCHAR(32)[] NOT NULL," +
+		"participants_key TEXT NOT NULL," +
+		"last_message INTEGER NOT NULL DEFAULT 0," +
+		"updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()," +
+		"UNIQUE (for_user, participants_key));")
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("CREATE INDEX threads_for_user_idx ON threads(for_user, last_message);")
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("ALTER TABLE messages ADD COLUMN thread INTEGER REFERENCES threads(id);")
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("CREATE INDEX messages_thread_idx ON messages(thread, id);")
+	if err != nil {
+		return err
+	}
+
+	return backfillThreads00004(tx)
+}
+
+func Down00004(tx *sql.Tx) error {
+	_, err := tx.Exec("ALTER TABLE messages DROP COLUMN thread;")
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DROP TABLE threads;")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+//backfillThreads00004 assigns all messages that were stored before threads existed to a thread.
+//This intentionally does not use the threads package, so that this migration's behavior can't change out from under it.
+func backfillThreads00004(tx *sql.Tx) error {
+	type storedMessage struct {
+		id           int
+		userID       int
+		participants []string
+	}
+
+	rows, err := tx.Query("SELECT id, for_user, phone_number, recipients FROM messages ORDER BY id;")
+	if err != nil {
+		return err
+	}
+
+	//We can't run other queries on this transaction while rows is open, so we must read everything first.
+	messages := make([]storedMessage, 0)
+	for rows.Next() {
+		var message storedMessage
+		var phoneNumber sql.NullString
+		var recipients []string
+		err = rows.Scan(&message.id, &message.userID, &phoneNumber, pq.Array(&recipients))
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		//A single recipient means the only recipient was the device itself.
+		participantSet := map[string]struct{}{phoneNumber.String: {}}
+		if len(recipients) > 1 {
+			for _, recipient := range recipients {
+				participantSet[recipient] = struct{}{}
+			}
+		}
+		for participant := range participantSet {
+			message.participants = append(message.participants, participant)
+		}
+		sort.Strings(message.participants)
+		messages = append(messages, message)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	for _, message := range messages {
+		var threadID int
+		threadRow := tx.QueryRow("INSERT INTO threads (for_user, participants, participants_key) VALUES($1, $2, $3) "+
+			"ON CONFLICT (for_user, participants_key) DO UPDATE SET participants_key = EXCLUDED.participants_key RETURNING id;",
+			message.userID, pq.Array(message.participants), strings.Join(message.participants, ","))
+		err = threadRow.Scan(&threadID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE messages SET thread = $1 WHERE id = $2;", threadID, message.id)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE threads SET last_message = $1, updated_at = messages.received_at FROM messages WHERE threads.id = $2 AND messages.id = $1;", message.id, threadID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,235 @@
+package migration
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/lib/pq"
+	"github.com/ollien/sms-pusher/server/config"
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(Up00005, Down00005)
+}
+
+func Up00005(tx *sql.Tx) error {
+	//phone_number and recipients now hold normalized numbers. The numbers as the carrier gave them to us are kept in the raw_ columns.
+	_, err := tx.Exec("ALTER TABLE messages " +
+		"ADD COLUMN raw_phone_number VARCHAR(32)," +
+		"ADD COLUMN raw_recipients VARCHAR(32)[];")
+	if err != nil {
+		return err
+	}
+
+	//Messages stored before normalization was added were never normalized, so their raw form is what we already have.
+	_, err = tx.Exec("UPDATE messages SET raw_phone_number = phone_number, raw_recipients = recipients;")
+	if err != nil {
+		return err
+	}
+
+	return normalizeMessages00005(tx)
+}
+
+func Down00005(tx *sql.Tx) error {
+	//Threads are left keyed by the normalized numbers, as there's no telling which raw form each thread was keyed by before.
+	_, err := tx.Exec("UPDATE messages SET phone_number = raw_phone_number, recipients = raw_recipients;")
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("ALTER TABLE messages " +
+		"DROP COLUMN raw_phone_number," +
+		"DROP COLUMN raw_recipients;")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+//region00005 stores the dialing rules for a region that are needed to convert its national numbers to E.164
+type region00005 struct {
+	countryCode          string
+	trunkPrefix          string
+	internationalPrefix  string
+	nationalNumberDigits int
+}
+
+//regions00005 is a copy of the dialing rules the phonenumber package had when this migration was written.
+//The rules, and the normalization below, are frozen here so that this migration always rewrites stored messages in the same way, no matter how the phonenumber package changes.
+var regions00005 = map[string]region00005{
+	"US": {countryCode: "1", trunkPrefix: "1", internationalPrefix: "011", nationalNumberDigits: 10},
+	"CA": {countryCode: "1", trunkPrefix: "1", internationalPrefix: "011", nationalNumberDigits: 10},
+	"GB": {countryCode: "44", trunkPrefix: "0", internationalPrefix: "00"},
+	"IE": {countryCode: "353", trunkPrefix: "0", internationalPrefix: "00"},
+	"DE": {countryCode: "49", trunkPrefix: "0", internationalPrefix: "00"},
+	"FR": {countryCode: "33", trunkPrefix: "0", internationalPrefix: "00", nationalNumberDigits: 9},
+	"NL": {countryCode: "31", trunkPrefix: "0", internationalPrefix: "00", nationalNumberDigits: 9},
+	"BE": {countryCode: "32", trunkPrefix: "0", internationalPrefix: "00"},
+	"CH": {countryCode: "41", trunkPrefix: "0", internationalPrefix: "00", nationalNumberDigits: 9},
+	"SE": {countryCode: "46", trunkPrefix: "0", internationalPrefix: "00"},
+	"ES": {countryCode: "34", internationalPrefix: "00", nationalNumberDigits: 9},
+	"IT": {countryCode: "39", internationalPrefix: "00"},
+	"AU": {countryCode: "61", trunkPrefix: "0", internationalPrefix: "0011", nationalNumberDigits: 9},
+	"NZ": {countryCode: "64", trunkPrefix: "0", internationalPrefix: "00"},
+	"IN": {countryCode: "91", trunkPrefix: "0", internationalPrefix: "00", nationalNumberDigits: 10},
+	"JP": {countryCode: "81", trunkPrefix: "0", internationalPrefix: "010"},
+}
+
+//normalizeMessages00005 normalizes the numbers of all messages stored before normalization was added, and moves them into the threads their normalized participants belong to, so that they share threads with new messages from the same people.
+//Numbers without a country code are taken to be in the configured phone.default_region, which must be set if there are any messages to normalize.
+func normalizeMessages00005(tx *sql.Tx) error {
+	type storedMessage struct {
+		id           int
+		userID       int
+		phoneNumber  sql.NullString
+		recipients   []string
+		participants []string
+	}
+
+	rows, err := tx.Query("SELECT id, for_user, phone_number, recipients FROM messages ORDER BY id;")
+	if err != nil {
+		return err
+	}
+
+	//We can't run other queries on this transaction while rows is open, so we must read everything first.
+	messages := make([]storedMessage, 0)
+	for rows.Next() {
+		var message storedMessage
+		err = rows.Scan(&message.id, &message.userID, &message.phoneNumber, pq.Array(&message.recipients))
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		messages = append(messages, message)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	if len(messages) == 0 {
+		return nil
+	}
+
+	appConfig, err := config.GetConfig()
+	if err != nil {
+		return err
+	}
+	if appConfig.Phone.DefaultRegion == "" {
+		return errors.New("migration 00005: phone.default_region must be set, as it is needed to normalize the numbers of stored messages")
+	}
+	defaultRegion, ok := regions00005[strings.ToUpper(appConfig.Phone.DefaultRegion)]
+	if !ok {
+		return fmt.Errorf("migration 00005: unsupported phone.default_region %s", appConfig.Phone.DefaultRegion)
+	}
+
+	for i := range messages {
+		message := &messages[i]
+		if message.phoneNumber.Valid {
+			message.phoneNumber.String = normalizeNumber00005(defaultRegion, message.phoneNumber.String)
+		}
+		//SMS have no recipients at all, which must stay NULL rather than becoming an empty array
+		for j, recipient := range message.recipients {
+			message.recipients[j] = normalizeNumber00005(defaultRegion, recipient)
+		}
+
+		//As in 00004, a single recipient means the only recipient was the device itself.
+		participantSet := map[string]struct{}{message.phoneNumber.String: {}}
+		if len(message.recipients) > 1 {
+			for _, recipient := range message.recipients {
+				participantSet[recipient] = struct{}{}
+			}
+		}
+		//The threads package leaves out missing numbers, so we must too for the keys to match
+		delete(participantSet, "")
+		for participant := range participantSet {
+			message.participants = append(message.participants, participant)
+		}
+		sort.Strings(message.participants)
+	}
+
+	for _, message := range messages {
+		var threadID int
+		threadRow := tx.QueryRow("INSERT INTO threads (for_user, participants, participants_key) VALUES($1, $2, $3) "+
+			"ON CONFLICT (for_user, participants_key) DO UPDATE SET participants_key = EXCLUDED.participants_key RETURNING id;",
+			message.userID, pq.Array(message.participants), strings.Join(message.participants, ","))
+		err = threadRow.Scan(&threadID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE messages SET phone_number = $1, recipients = $2, thread = $3 WHERE id = $4;",
+			message.phoneNumber, pq.Array(message.recipients), threadID, message.id)
+		if err != nil {
+			return err
+		}
+	}
+
+	//Threads that were keyed by raw numbers may have had all of their messages moved out of them.
+	_, err = tx.Exec("DELETE FROM threads WHERE NOT EXISTS (SELECT 1 FROM messages WHERE messages.thread = threads.id);")
+	if err != nil {
+		return err
+	}
+
+	//Threads that were merged must point at the newest of all their messages.
+	_, err = tx.Exec("UPDATE threads SET last_message = latest.id, updated_at = latest.received_at " +
+		"FROM (SELECT DISTINCT ON (thread) thread, id, received_at FROM messages WHERE thread IS NOT NULL ORDER BY thread, id DESC) AS latest " +
+		"WHERE threads.id = latest.thread;")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+//normalizeNumber00005 converts a number to E.164 in the same way as the phonenumber package did when this migration was written. Numbers that can't be converted are returned without surrounding whitespace.
+func normalizeNumber00005(defaultRegion region00005, rawNumber string) string {
+	const e164MaxDigits = 15
+	const minNationalDigits = 7
+
+	trimmedNumber := strings.TrimSpace(rawNumber)
+	makeE164 := func(digits string) string {
+		if len(digits) < minNationalDigits+1 || len(digits) > e164MaxDigits || digits[0] == '0' {
+			return trimmedNumber
+		}
+
+		return "+" + digits
+	}
+
+	digits := make([]rune, 0, len(trimmedNumber))
+	for _, char := range trimmedNumber {
+		if '0' <= char && char <= '9' {
+			digits = append(digits, char)
+		} else if unicode.IsLetter(char) || unicode.IsDigit(char) {
+			return trimmedNumber
+		}
+	}
+
+	number := string(digits)
+	if strings.HasPrefix(trimmedNumber, "+") {
+		return makeE164(number)
+	} else if strings.HasPrefix(number, defaultRegion.internationalPrefix) {
+		return makeE164(strings.TrimPrefix(number, defaultRegion.internationalPrefix))
+	}
+
+	nationalNumber := number
+	if defaultRegion.trunkPrefix != "" && strings.HasPrefix(nationalNumber, defaultRegion.trunkPrefix) {
+		if defaultRegion.nationalNumberDigits == 0 || len(nationalNumber) == defaultRegion.nationalNumberDigits+len(defaultRegion.trunkPrefix) {
+			nationalNumber = strings.TrimPrefix(nationalNumber, defaultRegion.trunkPrefix)
+		}
+	}
+
+	if len(nationalNumber) < minNationalDigits {
+		return trimmedNumber
+	} else if defaultRegion.nationalNumberDigits != 0 && len(nationalNumber) != defaultRegion.nationalNumberDigits {
+		return trimmedNumber
+	}
+
+	return makeE164(defaultRegion.countryCode + nationalNumber)
+}
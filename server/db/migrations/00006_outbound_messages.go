@@ -0,0 +1,42 @@
+package migration
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(Up00006, Down00006)
+}
+
+func Up00006(tx *sql.Tx) error {
+	//Create outbound_messages table
+	//id is the message_id of the payload sent to FCM, so that ACKs, NACKs, and receipts can be matched to it.
+	_, err := tx.Exec("CREATE TABLE outbound_messages (" +
+		"id VARCHAR(256) PRIMARY KEY," +
+		"device uuid REFERENCES devices(id)," +
+		"for_user INTEGER REFERENCES users(id)," +
+		"phone_number VARCHAR(32)," +
+		"raw_phone_number VARCHAR(32)," +
+		"body TEXT," +
+		"status VARCHAR(16) NOT NULL," +
+		"error VARCHAR(64)," +
+		"error_description TEXT," +
+		"created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()," +
+		"updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now());")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func Down00006(tx *sql.Tx) error {
+	_, err := tx.Exec("DROP TABLE outbound_messages;")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
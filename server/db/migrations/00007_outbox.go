@@ -0,0 +1,47 @@
+package migration
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(Up00007, Down00007)
+}
+
+func Up00007(tx *sql.Tx) error {
+	//outbound_messages doubles as the outbox. payload is the JSON of the payload that is sent to FCM, so that it can be sent again after a restart.
+	//dispatched_at is when the message was last claimed to be sent, and is NULL whenever the message is waiting to be dispatched.
+	_, err := tx.Exec("ALTER TABLE outbound_messages " +
+		"ADD COLUMN payload TEXT," +
+		"ADD COLUMN dispatch_attempts INTEGER NOT NULL DEFAULT 0," +
+		"ADD COLUMN dispatched_at TIMESTAMP WITH TIME ZONE;")
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("CREATE INDEX outbound_messages_status_idx ON outbound_messages(status, updated_at);")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func Down00007(tx *sql.Tx) error {
+	_, err := tx.Exec("DROP INDEX outbound_messages_status_idx;")
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("ALTER TABLE outbound_messages " +
+		"DROP COLUMN payload," +
+		"DROP COLUMN dispatch_attempts," +
+		"DROP COLUMN dispatched_at;")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
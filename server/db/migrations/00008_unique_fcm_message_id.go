@@ -0,0 +1,43 @@
+package migration
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(Up00008, Down00008)
+}
+
+func Up00008(tx *sql.Tx) error {
+	//Remove any messages that FCM has already given us twice, keeping the first copy.
+	_, err := tx.Exec("DELETE FROM messages duplicate USING messages original " +
+		"WHERE duplicate.device = original.device AND duplicate.fcm_message_id = original.fcm_message_id AND duplicate.id > original.id;")
+	if err != nil {
+		return err
+	}
+
+	//The deleted copies may have been the last message in their thread
+	_, err = tx.Exec("UPDATE threads SET last_message = COALESCE((SELECT MAX(id) FROM messages WHERE thread = threads.id), 0);")
+	if err != nil {
+		return err
+	}
+
+	//FCM message ids are chosen by the device, so they are only unique per device.
+	_, err = tx.Exec("ALTER TABLE messages ADD CONSTRAINT messages_device_fcm_message_id_key UNIQUE (device, fcm_message_id);")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func Down00008(tx *sql.Tx) error {
+	_, err := tx.Exec("ALTER TABLE messages DROP CONSTRAINT messages_device_fcm_message_id_key;")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package migration
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(Up00009, Down00009)
+}
+
+func Up00009(tx *sql.Tx) error {
+	//Sessions that already exist were made before they could expire, so they are given a fresh lifetime from now rather than being logged out at once.
+	_, err := tx.Exec("ALTER TABLE sessions " +
+		"ADD COLUMN created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()," +
+		"ADD COLUMN last_seen_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()," +
+		"ADD COLUMN expires_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now() + interval '30 days'," +
+		"ADD COLUMN user_agent TEXT NOT NULL DEFAULT ''," +
+		"ADD COLUMN ip_address TEXT NOT NULL DEFAULT '';")
+	if err != nil {
+		return err
+	}
+
+	//The default is only for existing sessions; new ones are always given an expiry by the server.
+	_, err = tx.Exec("ALTER TABLE sessions ALTER COLUMN expires_at DROP DEFAULT;")
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("CREATE INDEX sessions_for_user_idx ON sessions(for_user, expires_at);")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func Down00009(tx *sql.Tx) error {
+	_, err := tx.Exec("DROP INDEX sessions_for_user_idx;")
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("ALTER TABLE sessions " +
+		"DROP COLUMN created_at," +
+		"DROP COLUMN last_seen_at," +
+		"DROP COLUMN expires_at," +
+		"DROP COLUMN user_agent," +
+		"DROP COLUMN ip_address;")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
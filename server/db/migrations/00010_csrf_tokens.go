@@ -0,0 +1,74 @@
+package migration
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+
+	"github.com/pressly/goose"
+	uuid "github.com/satori/go.uuid"
+)
+
+//csrfTokenSize is the number of random bytes in a CSRF token
+const csrfTokenSize = 32
+
+func init() {
+	goose.AddMigration(Up00010, Down00010)
+}
+
+func Up00010(tx *sql.Tx) error {
+	_, err := tx.Exec("ALTER TABLE sessions ADD COLUMN csrf_token TEXT NOT NULL DEFAULT '';")
+	if err != nil {
+		return err
+	}
+
+	//Postgres has no cryptographically secure random function without an extension, so existing sessions' tokens are generated here.
+	rows, err := tx.Query("SELECT id FROM sessions;")
+	if err != nil {
+		return err
+	}
+
+	sessionIDs := make([]uuid.UUID, 0)
+	for rows.Next() {
+		var sessionID uuid.UUID
+		err = rows.Scan(&sessionID)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		sessionIDs = append(sessionIDs, sessionID)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+
+	for _, sessionID := range sessionIDs {
+		rawToken := make([]byte, csrfTokenSize)
+		_, err = rand.Read(rawToken)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE sessions SET csrf_token = $1 WHERE id = $2;", base64.RawURLEncoding.EncodeToString(rawToken), sessionID)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("ALTER TABLE sessions ALTER COLUMN csrf_token DROP DEFAULT;")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func Down00010(tx *sql.Tx) error {
+	_, err := tx.Exec("ALTER TABLE sessions DROP COLUMN csrf_token;")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
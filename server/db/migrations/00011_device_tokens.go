@@ -0,0 +1,34 @@
+package migration
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(Up00011, Down00011)
+}
+
+func Up00011(tx *sql.Tx) error {
+	//Only the SHA-256 hash of a device's token is stored. Devices that were registered before tokens existed have none until one is issued to them.
+	_, err := tx.Exec("ALTER TABLE devices " +
+		"ADD COLUMN token_hash bytea UNIQUE," +
+		"ADD COLUMN token_issued_at TIMESTAMP WITH TIME ZONE;")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func Down00011(tx *sql.Tx) error {
+	_, err := tx.Exec("ALTER TABLE devices " +
+		"DROP COLUMN token_hash," +
+		"DROP COLUMN token_issued_at;")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
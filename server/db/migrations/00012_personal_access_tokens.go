@@ -0,0 +1,39 @@
+package migration
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(Up00012, Down00012)
+}
+
+func Up00012(tx *sql.Tx) error {
+	//Only the SHA-256 hash of a token is stored. Tokens are named so that a user can tell them apart, and so names must be unique per user.
+	_, err := tx.Exec("CREATE TABLE personal_access_tokens (" +
+		"id SERIAL PRIMARY KEY," +
+		"for_user INTEGER NOT NULL REFERENCES users(id)," +
+		"name VARCHAR(64) NOT NULL," +
+		"token_hash bytea NOT NULL UNIQUE," +
+		"scopes TEXT[] NOT NULL," +
+		"created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()," +
+		"last_used_at TIMESTAMP WITH TIME ZONE," +
+		"expires_at TIMESTAMP WITH TIME ZONE NOT NULL," +
+		"UNIQUE (for_user, name));")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func Down00012(tx *sql.Tx) error {
+	_, err := tx.Exec("DROP TABLE personal_access_tokens;")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
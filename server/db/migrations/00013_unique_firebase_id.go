@@ -0,0 +1,41 @@
+package migration
+
+import (
+	"database/sql"
+
+	"github.com/pressly/goose"
+)
+
+func init() {
+	goose.AddMigration(Up00013, Down00013)
+}
+
+func Up00013(tx *sql.Tx) error {
+	//An FCM id may have moved between devices without being cleared from the old one. Only the device that sent a message most recently can still hold it, so the id is removed from the others.
+	_, err := tx.Exec("UPDATE devices SET firebase_id = NULL WHERE id IN (" +
+		"SELECT id FROM (" +
+		"SELECT devices.id, ROW_NUMBER() OVER (PARTITION BY devices.firebase_id " +
+		"ORDER BY (SELECT MAX(messages.id) FROM messages WHERE messages.device = devices.id) DESC NULLS LAST, devices.token_issued_at DESC NULLS LAST) AS recency " +
+		"FROM devices WHERE devices.firebase_id IS NOT NULL" +
+		") AS ranked WHERE ranked.recency > 1);")
+	if err != nil {
+		return err
+	}
+
+	//Devices that haven't registered an FCM id yet have a NULL firebase_id, which never conflicts
+	_, err = tx.Exec("CREATE UNIQUE INDEX devices_firebase_id_key ON devices(firebase_id);")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func Down00013(tx *sql.Tx) error {
+	_, err := tx.Exec("DROP INDEX devices_firebase_id_key;")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -1,6 +1,15 @@
 package db
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
 	uuid "github.com/satori/go.uuid"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -8,9 +17,55 @@ import (
 const (
 	//DuplicateUserError is a postgres specific error for duplicate users in our users db
 	DuplicateUserError = "pq: duplicate key value violates unique constraint \"users_username_key\""
-	passwordCost       = 10
+	//DuplicateMessageError is the error given when a device sends a message that has already been stored
+	DuplicateMessageError = "message has already been stored"
+	passwordCost          = 10
+	//uniqueViolationCode is the postgres error code for a violated unique constraint
+	uniqueViolationCode = "23505"
+	//dataExceptionClass and integrityViolationClass are the classes of postgres errors caused by what is being stored, such as a value that is too long or a foreign key that doesn't exist
+	dataExceptionClass      = "22"
+	integrityViolationClass = "23"
+	messageColumns          = "id, fcm_message_id, device, for_user, thread, phone_number, raw_phone_number, recipients, raw_recipients, body, block, mms, sent_at, received_at"
+	threadColumns           = "id, for_user, participants, last_message, updated_at"
+	outboundColumns         = "id, device, for_user, phone_number, raw_phone_number, body, status, error, error_description, created_at, updated_at, dispatch_attempts"
+	deviceColumns           = "id, firebase_id, for_user, token_hash IS NOT NULL"
+	sessionColumns          = "id, for_user, created_at, last_seen_at, expires_at, user_agent, ip_address, csrf_token"
+	//sessionTouchInterval is how long a session must go unused before using it again pushes back its expiry, so that every request doesn't need a write.
+	sessionTouchInterval = time.Minute
+	//csrfTokenSize is the number of random bytes in a CSRF token
+	csrfTokenSize = 32
+	//deviceTokenSize is the number of random bytes in a device token
+	deviceTokenSize    = 32
+	accessTokenColumns = "id, for_user, name, scopes, created_at, last_used_at, expires_at"
+	//PersonalAccessTokenPrefix begins every personal access token, so that they can be told apart from device tokens
+	PersonalAccessTokenPrefix = "smspat_"
+	//accessTokenSize is the number of random bytes in a personal access token
+	accessTokenSize = 32
+	//DispatchAttemptsExceededError is the error recorded for outbound messages that were dispatched too many times without FCM responding
+	DispatchAttemptsExceededError = "DISPATCH_ATTEMPTS_EXCEEDED"
 )
 
+//pendingOutboundStatuses are the statuses of outbound messages that FCM has not yet responded to, and so may need to be dispatched again.
+var pendingOutboundStatuses = []string{string(QueuedStatus), string(SentStatus), string(RetryingStatus)}
+
+//outboundStatusPredecessors maps each OutboundStatus to the statuses that may transition to it.
+//Updates from FCM can arrive out of order, so anything that would move a message backwards (e.g. a late ACK after a delivery receipt) is ignored.
+var outboundStatusPredecessors = map[OutboundStatus][]string{
+	//A message goes back to being queued if it could not be written to FCM, so that it will be dispatched again.
+	QueuedStatus:    {string(QueuedStatus), string(RetryingStatus)},
+	SentStatus:      {string(QueuedStatus), string(RetryingStatus)},
+	RetryingStatus:  {string(QueuedStatus), string(SentStatus), string(RetryingStatus)},
+	ACKedStatus:     {string(QueuedStatus), string(SentStatus), string(RetryingStatus)},
+	NACKedStatus:    {string(QueuedStatus), string(SentStatus), string(RetryingStatus)},
+	DeliveredStatus: {string(QueuedStatus), string(SentStatus), string(RetryingStatus), string(ACKedStatus)},
+	FailedStatus:    {string(QueuedStatus), string(RetryingStatus)},
+}
+
+//rowScanner allows for both *sql.Row and *sql.Rows to be scanned by the same function
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
 //CreateUser insersts a user into the database
 func (db DatabaseConnection) CreateUser(username string, password []byte) error {
 	hash, err := bcrypt.GenerateFromPassword(password, passwordCost)
@@ -92,52 +147,247 @@ func (db DatabaseConnection) VerifyUser(username string, password []byte) (User,
 	return user, nil
 }
 
-//CreateSession makes a session given a User
-func (db DatabaseConnection) CreateSession(user User) (Session, error) {
+//CreateSession makes a session given a User, recording the user agent and IP address of the client that it is being made for. A new CSRF token is generated for the session.
+//Any of the user's sessions that have expired are removed.
+func (db DatabaseConnection) CreateSession(user User, userAgent string, ipAddress string) (Session, error) {
 	sessionID, err := uuid.NewV4()
 	if err != nil {
 		return Session{}, db.handleError(err, true)
 	}
 
-	_, err = db.Exec("INSERT INTO sessions VALUES($1, $2);", sessionID, user.ID)
+	csrfToken, err := generateToken(csrfTokenSize)
 	if err != nil {
 		return Session{}, db.handleError(err, true)
 	}
 
-	return Session{
-		ID:   sessionID,
-		User: user,
-	}, nil
+	_, err = db.Exec("DELETE FROM sessions WHERE for_user = $1 AND expires_at <= now();", user.ID)
+	if err != nil {
+		return Session{}, db.handleError(err, true)
+	}
+
+	sessionRow := db.QueryRow("INSERT INTO sessions("+sessionColumns+") VALUES($1, $2, now(), now(), now() + make_interval(secs => $3), $4, $5, $6) RETURNING "+sessionColumns+";", sessionID, user.ID, db.sessionTimeout.Seconds(), userAgent, ipAddress, csrfToken)
+	session, err := scanSession(sessionRow)
+	if err != nil {
+		return Session{}, db.handleError(err, true)
+	}
+	session.User = user
+
+	return session, nil
 }
 
-//GetSession gets the user associated with a session
+//GetSession gets a session and the user associated with it. Sessions that have expired are not found.
+//Using a session pushes back its expiry.
 func (db DatabaseConnection) GetSession(sessionID uuid.UUID) (Session, error) {
-	sessionRow := db.QueryRow("SELECT for_user FROM sessions WHERE id = $1", sessionID)
-	var userID int
-	err := sessionRow.Scan(&userID)
+	sessionRow := db.QueryRow("SELECT "+sessionColumns+" FROM sessions WHERE id = $1 AND expires_at > now();", sessionID)
+	session, err := scanSession(sessionRow)
 	if err != nil {
 		return Session{}, db.handleError(err, false)
 	}
 
-	user, err := db.GetUserByID(userID)
+	if time.Since(session.LastSeenAt) >= sessionTouchInterval {
+		touchRow := db.QueryRow("UPDATE sessions SET last_seen_at = now(), expires_at = now() + make_interval(secs => $2) WHERE id = $1 RETURNING last_seen_at, expires_at;", sessionID, db.sessionTimeout.Seconds())
+		err = touchRow.Scan(&session.LastSeenAt, &session.ExpiresAt)
+		if err != nil {
+			return Session{}, db.handleError(err, true)
+		}
+	}
+
+	user, err := db.GetUserByID(session.User.ID)
 	if err != nil {
 		//GetUserByID will already have packaed the error
 		return Session{}, err
 	}
+	session.User = user
 
-	return Session{
-		ID:   sessionID,
-		User: user,
-	}, nil
+	return session, nil
+}
+
+//GetSessions gets all of a user's sessions that have not expired, most recently used first.
+func (db DatabaseConnection) GetSessions(user User) ([]Session, error) {
+	rows, err := db.Query("SELECT "+sessionColumns+" FROM sessions WHERE for_user = $1 AND expires_at > now() ORDER BY last_seen_at DESC;", user.ID)
+	if err != nil {
+		return nil, db.handleError(err, true)
+	}
+
+	defer rows.Close()
+	sessions := make([]Session, 0)
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, db.handleError(err, true)
+		}
+		session.User = user
+		sessions = append(sessions, session)
+	}
+
+	return sessions, db.handleError(rows.Err(), true)
+}
+
+//DeleteSession deletes one of a user's sessions, such that it can no longer be used.
+//If the user has no such session, a DatabaseError is returned that is not a DatabaseFault.
+func (db DatabaseConnection) DeleteSession(user User, sessionID uuid.UUID) error {
+	result, err := db.Exec("DELETE FROM sessions WHERE id = $1 AND for_user = $2;", sessionID, user.ID)
+	if err != nil {
+		return db.handleError(err, true)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return db.handleError(err, true)
+	}
+	if deleted == 0 {
+		return db.handleError(sql.ErrNoRows, false)
+	}
+
+	return nil
+}
+
+//CreatePersonalAccessToken makes a personal access token for a user, with the given name and scopes, that expires at expiresAt.
+//Only a hash of the token is stored, so the returned token can't be retrieved again. If the user already has a token with the same name, a DatabaseError is returned that is not a DatabaseFault.
+func (db DatabaseConnection) CreatePersonalAccessToken(user User, name string, scopes []string, expiresAt time.Time) (PersonalAccessToken, string, error) {
+	rawToken, err := generateToken(accessTokenSize)
+	if err != nil {
+		return PersonalAccessToken{}, "", db.handleError(err, true)
+	}
+	token := PersonalAccessTokenPrefix + rawToken
+
+	accessTokenRow := db.QueryRow("INSERT INTO personal_access_tokens(for_user, name, token_hash, scopes, expires_at) VALUES($1, $2, $3, $4, $5) RETURNING "+accessTokenColumns+";", user.ID, name, hashToken(token), pq.Array(scopes), expiresAt)
+	accessToken, err := scanAccessToken(accessTokenRow)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == uniqueViolationCode {
+		return PersonalAccessToken{}, "", db.handleError(err, false)
+	} else if err != nil {
+		return PersonalAccessToken{}, "", db.handleError(err, true)
+	}
+	accessToken.User = user
+
+	return accessToken, token, nil
+}
+
+//GetPersonalAccessToken gets a personal access token and the user it belongs to, and records that it has been used. Tokens that have expired are not found.
+func (db DatabaseConnection) GetPersonalAccessToken(token string) (PersonalAccessToken, error) {
+	accessTokenRow := db.QueryRow("UPDATE personal_access_tokens SET last_used_at = now() WHERE token_hash = $1 AND expires_at > now() RETURNING "+accessTokenColumns+";", hashToken(token))
+	accessToken, err := scanAccessToken(accessTokenRow)
+	if err != nil {
+		return PersonalAccessToken{}, db.handleError(err, false)
+	}
+
+	user, err := db.GetUserByID(accessToken.User.ID)
+	if err != nil {
+		//GetUserByID will already have packaged the error
+		return PersonalAccessToken{}, err
+	}
+	accessToken.User = user
+
+	return accessToken, nil
+}
+
+//GetPersonalAccessTokens gets all of a user's personal access tokens, including those that have expired, newest first.
+func (db DatabaseConnection) GetPersonalAccessTokens(user User) ([]PersonalAccessToken, error) {
+	rows, err := db.Query("SELECT "+accessTokenColumns+" FROM personal_access_tokens WHERE for_user = $1 ORDER BY id DESC;", user.ID)
+	if err != nil {
+		return nil, db.handleError(err, true)
+	}
+
+	defer rows.Close()
+	accessTokens := make([]PersonalAccessToken, 0)
+	for rows.Next() {
+		accessToken, err := scanAccessToken(rows)
+		if err != nil {
+			return nil, db.handleError(err, true)
+		}
+		accessToken.User = user
+		accessTokens = append(accessTokens, accessToken)
+	}
+
+	return accessTokens, db.handleError(rows.Err(), true)
+}
+
+//DeletePersonalAccessToken deletes one of a user's personal access tokens, such that it can no longer be used.
+//If the user has no such token, a DatabaseError is returned that is not a DatabaseFault.
+func (db DatabaseConnection) DeletePersonalAccessToken(user User, accessTokenID int) error {
+	result, err := db.Exec("DELETE FROM personal_access_tokens WHERE id = $1 AND for_user = $2;", accessTokenID, user.ID)
+	if err != nil {
+		return db.handleError(err, true)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return db.handleError(err, true)
+	}
+	if deleted == 0 {
+		return db.handleError(sql.ErrNoRows, false)
+	}
+
+	return nil
+}
+
+//scanAccessToken scans a row with accessTokenColumns into a PersonalAccessToken. Only the ID of the token's user is populated.
+func scanAccessToken(row rowScanner) (PersonalAccessToken, error) {
+	var accessToken PersonalAccessToken
+	var lastUsedAt pq.NullTime
+	err := row.Scan(&accessToken.ID, &accessToken.User.ID, &accessToken.Name, pq.Array(&accessToken.Scopes), &accessToken.CreatedAt, &lastUsedAt, &accessToken.ExpiresAt)
+	if err != nil {
+		return PersonalAccessToken{}, err
+	}
+	accessToken.LastUsedAt = lastUsedAt.Time
+
+	return accessToken, nil
+}
+
+//generateToken generates a random token from the given number of bytes, encoded such that it is safe to use in a URL or header
+func generateToken(size int) (string, error) {
+	rawToken := make([]byte, size)
+	_, err := rand.Read(rawToken)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(rawToken), nil
+}
+
+//hashToken hashes a token for storage. Tokens are random and long enough that a fast hash is sufficient.
+func hashToken(token string) []byte {
+	tokenHash := sha256.Sum256([]byte(token))
+
+	return tokenHash[:]
+}
+
+//scanSession scans a row with sessionColumns into a Session. Only the ID of the session's user is populated.
+func scanSession(row rowScanner) (Session, error) {
+	var session Session
+	err := row.Scan(&session.ID, &session.User.ID, &session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt, &session.UserAgent, &session.IPAddress, &session.CSRFToken)
+
+	return session, err
 }
 
 //GetDevice gets a Device from the database, given a deviceID
 func (db DatabaseConnection) GetDevice(deviceID uuid.UUID) (Device, error) {
-	deviceRow := db.QueryRow("SELECT * FROM devices WHERE id = $1", deviceID)
-	var internalDeviceID uuid.UUID
+	deviceRow := db.QueryRow("SELECT "+deviceColumns+" FROM devices WHERE id = $1", deviceID)
+
+	return db.scanDevice(deviceRow)
+}
+
+//GetDeviceByFCMID gets a Device from the database, given the FCM id (firebase_id) that it registered with
+func (db DatabaseConnection) GetDeviceByFCMID(fcmID []byte) (Device, error) {
+	deviceRow := db.QueryRow("SELECT "+deviceColumns+" FROM devices WHERE firebase_id = $1", fcmID)
+
+	return db.scanDevice(deviceRow)
+}
+
+//GetDeviceByToken gets a Device from the database, given the token that was issued to it
+func (db DatabaseConnection) GetDeviceByToken(token string) (Device, error) {
+	deviceRow := db.QueryRow("SELECT "+deviceColumns+" FROM devices WHERE token_hash = $1", hashToken(token))
+
+	return db.scanDevice(deviceRow)
+}
+
+//scanDevice scans a row with deviceColumns into a Device, and populates the User it belongs to
+func (db DatabaseConnection) scanDevice(deviceRow *sql.Row) (Device, error) {
+	var deviceID uuid.UUID
 	var fcmID []byte
 	var userID int
-	err := deviceRow.Scan(&internalDeviceID, &fcmID, &userID)
+	var hasToken bool
+	err := deviceRow.Scan(&deviceID, &fcmID, &userID, &hasToken)
 	if err != nil {
 		return Device{}, db.handleError(err, false)
 	}
@@ -150,11 +400,54 @@ func (db DatabaseConnection) GetDevice(deviceID uuid.UUID) (Device, error) {
 	}
 
 	return Device{
-		ID:    deviceID,
-		FCMID: fcmID,
-		User:  user,
+		ID:       deviceID,
+		FCMID:    fcmID,
+		User:     user,
+		HasToken: hasToken,
 	}, nil
+}
+
+//IssueDeviceToken issues a new token to one of a user's devices, which the device can use to authenticate as itself. Any token the device already had is revoked.
+//Only a hash of the token is stored, so the returned token can't be retrieved again. If the user has no such device, a DatabaseError is returned that is not a DatabaseFault.
+func (db DatabaseConnection) IssueDeviceToken(user User, deviceID uuid.UUID) (string, error) {
+	token, err := generateToken(deviceTokenSize)
+	if err != nil {
+		return "", db.handleError(err, true)
+	}
+
+	result, err := db.Exec("UPDATE devices SET token_hash = $1, token_issued_at = now() WHERE id = $2 AND for_user = $3;", hashToken(token), deviceID, user.ID)
+	if err != nil {
+		return "", db.handleError(err, true)
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return "", db.handleError(err, true)
+	}
+	if updated == 0 {
+		return "", db.handleError(sql.ErrNoRows, false)
+	}
 
+	return token, nil
+}
+
+//RevokeDeviceToken revokes the token of one of a user's devices, such that the device can no longer authenticate with it.
+//If the user has no such device, a DatabaseError is returned that is not a DatabaseFault.
+func (db DatabaseConnection) RevokeDeviceToken(user User, deviceID uuid.UUID) error {
+	result, err := db.Exec("UPDATE devices SET token_hash = NULL, token_issued_at = NULL WHERE id = $1 AND for_user = $2;", deviceID, user.ID)
+	if err != nil {
+		return db.handleError(err, true)
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return db.handleError(err, true)
+	}
+	if updated == 0 {
+		return db.handleError(sql.ErrNoRows, false)
+	}
+
+	return nil
 }
 
 //MakeFileBlock makes a file block in the database
@@ -179,31 +472,390 @@ func (db DatabaseConnection) RecordFile(fileName string, blockID uuid.UUID) erro
 	return db.handleError(err, true)
 }
 
-//RegisterDeviceToUser registers a device for a user
-func (db DatabaseConnection) RegisterDeviceToUser(user User) (Device, error) {
+//RegisterDeviceToUser registers a device for a user, and issues it a token. The token is returned along with the device, and can't be retrieved again.
+func (db DatabaseConnection) RegisterDeviceToUser(user User) (Device, string, error) {
 	deviceID, err := uuid.NewV4()
 	if err != nil {
-		return Device{}, db.handleError(err, true)
+		return Device{}, "", db.handleError(err, true)
 	}
 
-	deviceRow := db.QueryRow("INSERT INTO devices VALUES($1, NULL, $2) RETURNING *;", deviceID, user.ID)
+	token, err := generateToken(deviceTokenSize)
+	if err != nil {
+		return Device{}, "", db.handleError(err, true)
+	}
+
+	deviceRow := db.QueryRow("INSERT INTO devices(id, firebase_id, for_user, token_hash, token_issued_at) VALUES($1, NULL, $2, $3, now()) RETURNING id, firebase_id;", deviceID, user.ID, hashToken(token))
 	var internalDeviceID uuid.UUID
 	var fcmID []byte
-	var userID int
-	err = deviceRow.Scan(&internalDeviceID, &fcmID, &userID)
+	err = deviceRow.Scan(&internalDeviceID, &fcmID)
 	if err != nil {
-		return Device{}, db.handleError(err, true)
+		return Device{}, "", db.handleError(err, true)
 	}
 
 	return Device{
-		ID:    deviceID,
-		FCMID: fcmID,
-		User:  user,
-	}, nil
+		ID:       deviceID,
+		FCMID:    fcmID,
+		User:     user,
+		HasToken: true,
+	}, token, nil
 }
 
 //RegisterFCMID sets the FCM id (firebase_id) for a user's device, given a device id
+//FCM ids are unique to an app install, so if any other device had the same id, such as one that was registered before the app was reinstalled, it is removed from that device.
 func (db DatabaseConnection) RegisterFCMID(deviceID uuid.UUID, fcmID []byte) error {
-	_, err := db.Exec("UPDATE devices SET firebase_id = $1 WHERE id = $2;", fcmID, deviceID)
+	tx, err := db.Begin()
+	if err != nil {
+		return db.handleError(err, true)
+	}
+
+	_, err = tx.Exec("UPDATE devices SET firebase_id = NULL WHERE firebase_id = $1 AND id <> $2;", fcmID, deviceID)
+	if err != nil {
+		tx.Rollback()
+		return db.handleError(err, true)
+	}
+
+	_, err = tx.Exec("UPDATE devices SET firebase_id = $1 WHERE id = $2;", fcmID, deviceID)
+	if err != nil {
+		tx.Rollback()
+		return db.handleError(err, true)
+	}
+
+	err = tx.Commit()
+
 	return db.handleError(err, true)
 }
+
+//RecordMessage stores a message that was sent upstream from the given device in the thread between the device's user and the given participants, and marks it as the latest message in that thread.
+//The thread is created if it does not exist; participants must already be normalized, as the thread is found by exact match. Threads are only ever created alongside their first message, so that none are left without one.
+//The stored message is returned, with its ID, DeviceID, UserID, ThreadID and ReceivedAt populated.
+//If the device has already sent a message with the same FCMMessageID, nothing is stored and a DatabaseError that is not a DatabaseFault is returned, with the error DuplicateMessageError.
+//Messages that can never be stored, such as those that reference an MMS block that doesn't exist or have numbers too long to store, also produce a DatabaseError that is not a DatabaseFault.
+func (db DatabaseConnection) RecordMessage(device Device, message Message, participants []string) (Message, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return Message{}, db.handleError(err, true)
+	}
+
+	//The DO UPDATE is a no-op, but is needed so that RETURNING produces the existing row on a conflict.
+	threadRow := tx.QueryRow("INSERT INTO threads (for_user, participants, participants_key) VALUES($1, $2, $3) "+
+		"ON CONFLICT (for_user, participants_key) DO UPDATE SET participants_key = EXCLUDED.participants_key RETURNING id;",
+		device.User.ID, pq.Array(participants), strings.Join(participants, ","))
+	err = threadRow.Scan(&message.ThreadID)
+	if err != nil {
+		//Numbers that couldn't be normalized are used as participants as they are, and may not fit
+		tx.Rollback()
+		return Message{}, db.handleError(err, !isUnstorableError(err))
+	}
+
+	messageRow := tx.QueryRow("INSERT INTO messages (fcm_message_id, device, for_user, thread, phone_number, raw_phone_number, recipients, raw_recipients, body, block, mms, sent_at) "+
+		"VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) ON CONFLICT (device, fcm_message_id) DO NOTHING RETURNING id, received_at;",
+		message.FCMMessageID, device.ID, device.User.ID, message.ThreadID, message.PhoneNumber, message.RawPhoneNumber, pq.Array(message.Recipients), pq.Array(message.RawRecipients), message.Body, message.BlockID, message.MMS, message.SentAt)
+	err = messageRow.Scan(&message.ID, &message.ReceivedAt)
+	if err == sql.ErrNoRows {
+		//Nothing is returned if the insert conflicted, meaning this message is a duplicate
+		tx.Rollback()
+		return Message{}, db.handleError(errors.New(DuplicateMessageError), false)
+	} else if isUnstorableError(err) {
+		tx.Rollback()
+		return Message{}, db.handleError(err, false)
+	} else if err != nil {
+		tx.Rollback()
+		return Message{}, db.handleError(err, true)
+	}
+
+	_, err = tx.Exec("UPDATE threads SET last_message = $1, updated_at = $2 WHERE id = $3;", message.ID, message.ReceivedAt, message.ThreadID)
+	if err != nil {
+		tx.Rollback()
+		return Message{}, db.handleError(err, true)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return Message{}, db.handleError(err, true)
+	}
+
+	message.DeviceID = device.ID
+	message.UserID = device.User.ID
+
+	return message, nil
+}
+
+//isUnstorableError checks whether err was caused by the values being stored, rather than by the database, meaning that they can never be stored
+func isUnstorableError(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+
+	return ok && (pqErr.Code.Class() == dataExceptionClass || pqErr.Code.Class() == integrityViolationClass)
+}
+
+//GetMessage gets a single stored message, given its id
+func (db DatabaseConnection) GetMessage(messageID int) (Message, error) {
+	messageRow := db.QueryRow("SELECT "+messageColumns+" FROM messages WHERE id = $1;", messageID)
+	message, err := scanMessage(messageRow)
+	if err != nil {
+		return Message{}, db.handleError(err, false)
+	}
+
+	return message, nil
+}
+
+//GetMessages gets the most recent messages for a user, newest first. At most limit messages will be returned.
+func (db DatabaseConnection) GetMessages(user User, limit int) ([]Message, error) {
+	rows, err := db.Query("SELECT "+messageColumns+" FROM messages WHERE for_user = $1 ORDER BY id DESC LIMIT $2;", user.ID, limit)
+	if err != nil {
+		return nil, db.handleError(err, true)
+	}
+
+	defer rows.Close()
+
+	return db.scanMessages(rows)
+}
+
+//GetMessagesSince gets the messages for a user that were stored after the message with the given id, oldest first. At most limit messages will be returned.
+func (db DatabaseConnection) GetMessagesSince(user User, afterID int, limit int) ([]Message, error) {
+	rows, err := db.Query("SELECT "+messageColumns+" FROM messages WHERE for_user = $1 AND id > $2 ORDER BY id ASC LIMIT $3;", user.ID, afterID, limit)
+	if err != nil {
+		return nil, db.handleError(err, true)
+	}
+
+	defer rows.Close()
+
+	return db.scanMessages(rows)
+}
+
+//GetThread gets a single thread, given its id
+func (db DatabaseConnection) GetThread(threadID int) (Thread, error) {
+	threadRow := db.QueryRow("SELECT "+threadColumns+" FROM threads WHERE id = $1;", threadID)
+	thread, err := scanThread(threadRow)
+	if err != nil {
+		return Thread{}, db.handleError(err, false)
+	}
+
+	return thread, nil
+}
+
+//GetThreads gets a user's threads that have messages, most recently active first. Only threads whose last message is older than the message with id beforeMessageID are returned, unless beforeMessageID is zero.
+//At most limit threads will be returned.
+func (db DatabaseConnection) GetThreads(user User, beforeMessageID int, limit int) ([]Thread, error) {
+	var rows *sql.Rows
+	var err error
+	if beforeMessageID == 0 {
+		rows, err = db.Query("SELECT "+threadColumns+" FROM threads WHERE for_user = $1 AND last_message <> 0 ORDER BY last_message DESC LIMIT $2;", user.ID, limit)
+	} else {
+		rows, err = db.Query("SELECT "+threadColumns+" FROM threads WHERE for_user = $1 AND last_message <> 0 AND last_message < $2 ORDER BY last_message DESC LIMIT $3;", user.ID, beforeMessageID, limit)
+	}
+	if err != nil {
+		return nil, db.handleError(err, true)
+	}
+
+	defer rows.Close()
+	threads := make([]Thread, 0)
+	for rows.Next() {
+		thread, err := scanThread(rows)
+		if err != nil {
+			return nil, db.handleError(err, true)
+		}
+		threads = append(threads, thread)
+	}
+
+	return threads, db.handleError(rows.Err(), true)
+}
+
+//GetThreadMessages gets the messages within a thread, newest first. Only messages older than the message with id beforeMessageID are returned, unless beforeMessageID is zero.
+//At most limit messages will be returned.
+func (db DatabaseConnection) GetThreadMessages(thread Thread, beforeMessageID int, limit int) ([]Message, error) {
+	var rows *sql.Rows
+	var err error
+	if beforeMessageID == 0 {
+		rows, err = db.Query("SELECT "+messageColumns+" FROM messages WHERE thread = $1 ORDER BY id DESC LIMIT $2;", thread.ID, limit)
+	} else {
+		rows, err = db.Query("SELECT "+messageColumns+" FROM messages WHERE thread = $1 AND id < $2 ORDER BY id DESC LIMIT $3;", thread.ID, beforeMessageID, limit)
+	}
+	if err != nil {
+		return nil, db.handleError(err, true)
+	}
+
+	defer rows.Close()
+
+	return db.scanMessages(rows)
+}
+
+//scanMessages scans every row in rows into a Message
+func (db DatabaseConnection) scanMessages(rows *sql.Rows) ([]Message, error) {
+	messages := make([]Message, 0)
+	for rows.Next() {
+		message, err := scanMessage(rows)
+		if err != nil {
+			return nil, db.handleError(err, true)
+		}
+		messages = append(messages, message)
+	}
+
+	return messages, db.handleError(rows.Err(), true)
+}
+
+//scanMessage scans a single row, selected with messageColumns, into a Message
+func scanMessage(row rowScanner) (Message, error) {
+	var message Message
+	//Columns that may be NULL must be scanned into nullable types
+	var fcmMessageID, phoneNumber, rawPhoneNumber, body sql.NullString
+	var threadID sql.NullInt64
+	var sentAt pq.NullTime
+	err := row.Scan(&message.ID, &fcmMessageID, &message.DeviceID, &message.UserID, &threadID, &phoneNumber, &rawPhoneNumber, pq.Array(&message.Recipients), pq.Array(&message.RawRecipients), &body, &message.BlockID, &message.MMS, &sentAt, &message.ReceivedAt)
+	if err != nil {
+		return Message{}, err
+	}
+
+	message.ThreadID = int(threadID.Int64)
+	message.FCMMessageID = fcmMessageID.String
+	message.PhoneNumber = phoneNumber.String
+	message.RawPhoneNumber = rawPhoneNumber.String
+	message.Body = body.String
+	message.SentAt = sentAt.Time
+
+	return message, nil
+}
+
+//scanThread scans a single row, selected with threadColumns, into a Thread
+func scanThread(row rowScanner) (Thread, error) {
+	var thread Thread
+	err := row.Scan(&thread.ID, &thread.UserID, pq.Array(&thread.Participants), &thread.LastMessageID, &thread.UpdatedAt)
+
+	return thread, err
+}
+
+//ClearFCMID removes the FCM id from a device, given that its FCM id is still fcmID. Used when FCM has told us that an FCM id is no longer valid.
+//Returns true if the FCM id was cleared. If the device has since registered a new FCM id, it is left alone and false is returned.
+func (db DatabaseConnection) ClearFCMID(deviceID uuid.UUID, fcmID []byte) (bool, error) {
+	result, err := db.Exec("UPDATE devices SET firebase_id = NULL WHERE id = $1 AND firebase_id = $2;", deviceID, fcmID)
+	if err != nil {
+		return false, db.handleError(err, true)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, db.handleError(err, true)
+	}
+
+	return rowsAffected > 0, nil
+}
+
+//RecordOutboundMessage stores a message in the outbox, with a status of QueuedStatus, so that it can be dispatched to FCM. message.Payload must be set.
+func (db DatabaseConnection) RecordOutboundMessage(device Device, message OutboundMessage) (OutboundMessage, error) {
+	message.DeviceID = device.ID
+	message.UserID = device.User.ID
+	message.Status = QueuedStatus
+	outboundRow := db.QueryRow("INSERT INTO outbound_messages (id, device, for_user, phone_number, raw_phone_number, body, status, payload) "+
+		"VALUES($1, $2, $3, $4, $5, $6, $7, $8) RETURNING created_at, updated_at;",
+		message.ID, message.DeviceID, message.UserID, message.PhoneNumber, message.RawPhoneNumber, message.Body, message.Status, string(message.Payload))
+	err := outboundRow.Scan(&message.CreatedAt, &message.UpdatedAt)
+	if err != nil {
+		return OutboundMessage{}, db.handleError(err, true)
+	}
+
+	return message, nil
+}
+
+//ClaimOutboundMessages claims up to limit outbound messages with one of the given statuses that need to be dispatched to FCM, oldest first, and increments their dispatch attempts.
+//Messages that are waiting to be dispatched, including those that went back to being queued, are always claimed. Messages that were last dispatched before staleBefore are claimed again, as their dispatch has presumably been lost.
+//Messages that have already been dispatched maxAttempts times are never claimed, and are left for FailExhaustedOutboundMessages. The returned messages have their Payload populated.
+func (db DatabaseConnection) ClaimOutboundMessages(limit int, statuses []OutboundStatus, staleBefore time.Time, maxAttempts int) ([]OutboundMessage, error) {
+	rawStatuses := make([]string, 0, len(statuses))
+	for _, status := range statuses {
+		rawStatuses = append(rawStatuses, string(status))
+	}
+
+	//SKIP LOCKED allows multiple dispatchers to claim at once without claiming the same message.
+	rows, err := db.Query("UPDATE outbound_messages SET dispatch_attempts = dispatch_attempts + 1, dispatched_at = now(), updated_at = now() "+
+		"WHERE id IN (SELECT id FROM outbound_messages "+
+		"WHERE payload IS NOT NULL AND status = ANY($1) AND dispatch_attempts < $2 AND (dispatched_at IS NULL OR dispatched_at < $3) "+
+		"ORDER BY created_at LIMIT $4 FOR UPDATE SKIP LOCKED) "+
+		"RETURNING "+outboundColumns+", payload;",
+		pq.Array(rawStatuses), maxAttempts, staleBefore, limit)
+	if err != nil {
+		return nil, db.handleError(err, true)
+	}
+
+	defer rows.Close()
+	messages := make([]OutboundMessage, 0)
+	for rows.Next() {
+		var payload string
+		message, err := scanOutboundMessage(rows, &payload)
+		if err != nil {
+			return nil, db.handleError(err, true)
+		}
+		message.Payload = []byte(payload)
+		messages = append(messages, message)
+	}
+
+	return messages, db.handleError(rows.Err(), true)
+}
+
+//FailExhaustedOutboundMessages marks every outbound message that has been dispatched at least maxAttempts times, and that FCM has not responded to for longer than staleAfter, as failed.
+//The failed messages are returned.
+func (db DatabaseConnection) FailExhaustedOutboundMessages(maxAttempts int, staleAfter time.Duration) ([]OutboundMessage, error) {
+	rows, err := db.Query("UPDATE outbound_messages SET status = $1, error = $2, updated_at = now() "+
+		"WHERE status = ANY($3) AND dispatch_attempts >= $4 AND updated_at < now() - make_interval(secs => $5) "+
+		"RETURNING "+outboundColumns+";",
+		FailedStatus, DispatchAttemptsExceededError, pq.Array(pendingOutboundStatuses), maxAttempts, staleAfter.Seconds())
+	if err != nil {
+		return nil, db.handleError(err, true)
+	}
+
+	defer rows.Close()
+	messages := make([]OutboundMessage, 0)
+	for rows.Next() {
+		message, err := scanOutboundMessage(rows)
+		if err != nil {
+			return nil, db.handleError(err, true)
+		}
+		messages = append(messages, message)
+	}
+
+	return messages, db.handleError(rows.Err(), true)
+}
+
+//GetOutboundMessage gets an outbound message, given the message_id it was sent to FCM with
+func (db DatabaseConnection) GetOutboundMessage(messageID string) (OutboundMessage, error) {
+	outboundRow := db.QueryRow("SELECT "+outboundColumns+" FROM outbound_messages WHERE id = $1;", messageID)
+	message, err := scanOutboundMessage(outboundRow)
+	if err != nil {
+		return OutboundMessage{}, db.handleError(err, false)
+	}
+
+	return message, nil
+}
+
+//UpdateOutboundStatus moves an outbound message to a new status, recording the given error, if any, and returns the updated message.
+//A message that goes back to QueuedStatus may be claimed by ClaimOutboundMessages again right away.
+//If the message does not exist, or could not move to the new status from its current one, an error is returned with DatabaseFault set to false.
+func (db DatabaseConnection) UpdateOutboundStatus(messageID string, status OutboundStatus, errorCode string, errorDescription string) (OutboundMessage, error) {
+	outboundRow := db.QueryRow("UPDATE outbound_messages SET status = $2, error = $3, error_description = $4, updated_at = now(), "+
+		"dispatched_at = CASE WHEN $2 = $6 THEN NULL ELSE dispatched_at END "+
+		"WHERE id = $1 AND status = ANY($5) RETURNING "+outboundColumns+";",
+		messageID, status, errorCode, errorDescription, pq.Array(outboundStatusPredecessors[status]), QueuedStatus)
+	message, err := scanOutboundMessage(outboundRow)
+	if err != nil {
+		return OutboundMessage{}, db.handleError(err, false)
+	}
+
+	return message, nil
+}
+
+//scanOutboundMessage scans a single row, selected with outboundColumns, into an OutboundMessage. Any columns selected after outboundColumns are scanned into extraDest.
+func scanOutboundMessage(row rowScanner, extraDest ...interface{}) (OutboundMessage, error) {
+	var message OutboundMessage
+	var phoneNumber, rawPhoneNumber, body, errorCode, errorDescription sql.NullString
+	dest := []interface{}{&message.ID, &message.DeviceID, &message.UserID, &phoneNumber, &rawPhoneNumber, &body, &message.Status, &errorCode, &errorDescription, &message.CreatedAt, &message.UpdatedAt, &message.DispatchAttempts}
+	err := row.Scan(append(dest, extraDest...)...)
+	if err != nil {
+		return OutboundMessage{}, err
+	}
+
+	message.PhoneNumber = phoneNumber.String
+	message.RawPhoneNumber = rawPhoneNumber.String
+	message.Body = body.String
+	message.Error = errorCode.String
+	message.ErrorDescription = errorDescription.String
+
+	return message, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/ollien/sms-pusher/server/db"
+	"github.com/ollien/sms-pusher/server/events"
+	"github.com/ollien/sms-pusher/server/firebasexmpp"
+	"github.com/sirupsen/logrus"
+)
+
+//listenForDeliveryUpdates listens for changes in the status of downstream messages, records them, and notifies the user that sent the message of them.
+//Messages that could not be sent go back into the outbox, which is notified on outboxChannel so that they are dispatched again right away.
+func listenForDeliveryUpdates(deliveryChannel <-chan firebasexmpp.DeliveryUpdate, outboxChannel chan<- struct{}, databaseConnection db.DatabaseConnection, eventHub *events.Hub, logger *logrus.Logger) {
+	for update := range deliveryChannel {
+		logEntry := logger.WithField("message_id", update.MessageID)
+		status, err := getOutboundStatus(update.Status)
+		if err != nil {
+			logEntry.Error(err)
+			continue
+		}
+
+		errorCode, errorDescription := update.ErrorCode, update.ErrorDescription
+		if update.Err != nil {
+			errorDescription = update.Err.Error()
+		}
+
+		message, err := databaseConnection.UpdateOutboundStatus(update.MessageID, status, errorCode, errorDescription)
+		if dbErr, ok := err.(*db.DatabaseError); ok && !dbErr.DatabaseFault {
+			//Either we don't know about this message, or it has already moved past this status.
+			logEntry.Debugf("Ignoring %s update: %s", status, err)
+			continue
+		} else if err != nil {
+			logEntry.Errorf("Could not update message status: %s", err)
+			continue
+		}
+
+		eventHub.Publish(events.NewDeliveryStatusEvent(message))
+		if status == db.QueuedStatus {
+			//If the dispatcher already has a notification pending, it will pick this message up anyway.
+			select {
+			case outboxChannel <- struct{}{}:
+			default:
+			}
+		}
+		if update.Status == firebasexmpp.NACKStatus && firebasexmpp.IsRegistrationInvalidNACK(update.ErrorCode) {
+			clearInvalidFCMID(message, update.RegistrationID, databaseConnection, eventHub, logEntry)
+		}
+	}
+}
+
+//clearInvalidFCMID removes an FCM id that FCM has rejected from the device that an outbound message was sent from, so that we stop sending to it.
+func clearInvalidFCMID(message db.OutboundMessage, fcmID string, databaseConnection db.DatabaseConnection, eventHub *events.Hub, logEntry *logrus.Entry) {
+	device, err := databaseConnection.GetDevice(message.DeviceID)
+	if err != nil {
+		logEntry.Errorf("Could not find device to clear FCM id from: %s", err)
+		return
+	}
+
+	cleared, err := databaseConnection.ClearFCMID(device.ID, []byte(fcmID))
+	if err != nil {
+		logEntry.Errorf("Could not clear FCM id: %s", err)
+		return
+	} else if cleared {
+		logEntry.WithField("device", device.ID.String()).Warn("Cleared FCM id rejected by FCM")
+		eventHub.Publish(events.NewDeviceStatusEvent(device.User, device.ID, events.DeviceFCMIDClearedStatus))
+	}
+}
+
+//getOutboundStatus converts a firebasexmpp.DeliveryStatus to the corresponding db.OutboundStatus
+func getOutboundStatus(status firebasexmpp.DeliveryStatus) (db.OutboundStatus, error) {
+	switch status {
+	case firebasexmpp.SentStatus:
+		return db.SentStatus, nil
+	case firebasexmpp.SendFailedStatus:
+		//The outbox will dispatch the message again
+		return db.QueuedStatus, nil
+	case firebasexmpp.ACKStatus:
+		return db.ACKedStatus, nil
+	case firebasexmpp.RetryingStatus:
+		return db.RetryingStatus, nil
+	case firebasexmpp.NACKStatus:
+		return db.NACKedStatus, nil
+	case firebasexmpp.DeliveredStatus:
+		return db.DeliveredStatus, nil
+	default:
+		return "", fmt.Errorf("unknown delivery status %d", status)
+	}
+}
@@ -0,0 +1,142 @@
+package events
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/ollien/sms-pusher/server/db"
+	uuid "github.com/satori/go.uuid"
+)
+
+//Type represents the kind of event that has occurred
+type Type string
+
+const (
+	//IncomingMessageType is the type of event produced when a device sends a message upstream
+	IncomingMessageType Type = "incoming_message"
+	//DeliveryStatusType is the type of event produced when an outbound message's status changes
+	DeliveryStatusType Type = "delivery_status"
+	//DeviceStatusType is the type of event produced when something about a device has changed
+	DeviceStatusType Type = "device_status"
+)
+
+const (
+	//DeviceRegisteredStatus indicates that a new device was registered
+	DeviceRegisteredStatus = "registered"
+	//DeviceFCMIDUpdatedStatus indicates that a device has set a new FCM id
+	DeviceFCMIDUpdatedStatus = "fcm_id_updated"
+	//DeviceFCMIDClearedStatus indicates that FCM rejected a device's FCM id, so it has been removed. The device can't be sent to until it sets a new one.
+	DeviceFCMIDClearedStatus = "fcm_id_cleared"
+)
+
+//Event represents something that happened that a user's clients should be told about.
+//ID is only set for events that can be resumed from, such as those for stored messages.
+type Event struct {
+	ID     string      `json:"id,omitempty"`
+	Type   Type        `json:"type"`
+	UserID int         `json:"-"`
+	Data   interface{} `json:"data"`
+}
+
+//MessageData represents a stored text message. Used for marshalling JSON.
+type MessageData struct {
+	ID             int       `json:"id"`
+	DeviceID       string    `json:"device_id"`
+	ThreadID       int       `json:"thread_id,omitempty"`
+	PhoneNumber    string    `json:"phone_number"`
+	RawPhoneNumber string    `json:"raw_phone_number"`
+	Recipients     []string  `json:"recipients,omitempty"`
+	RawRecipients  []string  `json:"raw_recipients,omitempty"`
+	Body           string    `json:"body"`
+	BlockID        string    `json:"block_id,omitempty"`
+	MMS            bool      `json:"mms"`
+	SentAt         time.Time `json:"sent_at"`
+	ReceivedAt     time.Time `json:"received_at"`
+}
+
+//OutboundMessageData represents an outbound message and its status. Used for marshalling JSON.
+type OutboundMessageData struct {
+	MessageID        string    `json:"message_id"`
+	DeviceID         string    `json:"device_id"`
+	PhoneNumber      string    `json:"phone_number"`
+	RawPhoneNumber   string    `json:"raw_phone_number"`
+	Status           string    `json:"status"`
+	Error            string    `json:"error,omitempty"`
+	ErrorDescription string    `json:"error_description,omitempty"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+//DeviceStatusData represents a change in a device. Used for marshalling JSON.
+type DeviceStatusData struct {
+	DeviceID string `json:"device_id"`
+	Status   string `json:"status"`
+}
+
+//NewMessageData converts a db.Message to a MessageData
+func NewMessageData(message db.Message) MessageData {
+	data := MessageData{
+		ID:             message.ID,
+		DeviceID:       message.DeviceID.String(),
+		ThreadID:       message.ThreadID,
+		PhoneNumber:    message.PhoneNumber,
+		RawPhoneNumber: message.RawPhoneNumber,
+		Recipients:     message.Recipients,
+		RawRecipients:  message.RawRecipients,
+		Body:           message.Body,
+		MMS:            message.MMS,
+		SentAt:         message.SentAt,
+		ReceivedAt:     message.ReceivedAt,
+	}
+	if message.BlockID.Valid {
+		data.BlockID = message.BlockID.UUID.String()
+	}
+
+	return data
+}
+
+//NewIncomingMessageEvent is a convenience function to construct an Event with type IncomingMessageType
+func NewIncomingMessageEvent(message db.Message) Event {
+	return Event{
+		ID:     strconv.Itoa(message.ID),
+		Type:   IncomingMessageType,
+		UserID: message.UserID,
+		Data:   NewMessageData(message),
+	}
+}
+
+//NewOutboundMessageData converts a db.OutboundMessage to an OutboundMessageData
+func NewOutboundMessageData(message db.OutboundMessage) OutboundMessageData {
+	return OutboundMessageData{
+		MessageID:        message.ID,
+		DeviceID:         message.DeviceID.String(),
+		PhoneNumber:      message.PhoneNumber,
+		RawPhoneNumber:   message.RawPhoneNumber,
+		Status:           string(message.Status),
+		Error:            message.Error,
+		ErrorDescription: message.ErrorDescription,
+		CreatedAt:        message.CreatedAt,
+		UpdatedAt:        message.UpdatedAt,
+	}
+}
+
+//NewDeliveryStatusEvent is a convenience function to construct an Event with type DeliveryStatusType
+func NewDeliveryStatusEvent(message db.OutboundMessage) Event {
+	return Event{
+		Type:   DeliveryStatusType,
+		UserID: message.UserID,
+		Data:   NewOutboundMessageData(message),
+	}
+}
+
+//NewDeviceStatusEvent is a convenience function to construct an Event with type DeviceStatusType
+func NewDeviceStatusEvent(user db.User, deviceID uuid.UUID, status string) Event {
+	return Event{
+		Type:   DeviceStatusType,
+		UserID: user.ID,
+		Data: DeviceStatusData{
+			DeviceID: deviceID.String(),
+			Status:   status,
+		},
+	}
+}
@@ -0,0 +1,148 @@
+package events
+
+import (
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	//publishBufferSize is the number of events that may be waiting to be fanned out before Publish starts dropping them.
+	publishBufferSize = 256
+	//subscriptionBufferSize is the number of events a single subscriber may fall behind by before it is dropped.
+	subscriptionBufferSize = 64
+)
+
+//Hub fans out published events to every subscription belonging to the event's user.
+//Publishing never blocks, so that a slow client can never hold up the XMPP receive path. Subscribers that can't keep up are dropped instead.
+type Hub struct {
+	logger             *logrus.Logger
+	publishChannel     chan Event
+	subscribeChannel   chan *Subscription
+	unsubscribeChannel chan *Subscription
+	closeChannel       chan struct{}
+	closeOnce          sync.Once
+	//closed is set once the hub has been closed, after which new subscriptions are closed immediately. It is only touched by run.
+	closed        bool
+	subscriptions map[int]map[*Subscription]struct{}
+}
+
+//Subscription represents a single listener for a user's events, such as one open browser tab.
+type Subscription struct {
+	UserID int
+	events chan Event
+	hub    *Hub
+}
+
+//NewHub creates a new Hub and starts the routine that fans out its events.
+func NewHub(logger *logrus.Logger) *Hub {
+	hub := &Hub{
+		logger:             logger,
+		publishChannel:     make(chan Event, publishBufferSize),
+		subscribeChannel:   make(chan *Subscription),
+		unsubscribeChannel: make(chan *Subscription),
+		closeChannel:       make(chan struct{}),
+		subscriptions:      make(map[int]map[*Subscription]struct{}),
+	}
+
+	go hub.run()
+
+	return hub
+}
+
+//Publish sends an event to all of the subscriptions for event.UserID.
+//If the hub is too backed up to accept the event, it is dropped and a warning is logged.
+func (hub *Hub) Publish(event Event) {
+	select {
+	case hub.publishChannel <- event:
+	default:
+		hub.logger.WithField("type", event.Type).Warn("Event hub is full; dropping event")
+	}
+}
+
+//Subscribe creates a new Subscription that will receive all events for the given user.
+func (hub *Hub) Subscribe(userID int) *Subscription {
+	subscription := &Subscription{
+		UserID: userID,
+		events: make(chan Event, subscriptionBufferSize),
+		hub:    hub,
+	}
+	hub.subscribeChannel <- subscription
+
+	return subscription
+}
+
+//Close closes every subscription, so that every stream of events ends. Subscriptions made after the hub is closed are closed immediately.
+//Closing a hub that is already closed does nothing.
+func (hub *Hub) Close() {
+	hub.closeOnce.Do(func() {
+		close(hub.closeChannel)
+	})
+}
+
+//run handles all modifications to hub.subscriptions, and performs the fan out of events.
+func (hub *Hub) run() {
+	for {
+		select {
+		case subscription := <-hub.subscribeChannel:
+			if hub.closed {
+				close(subscription.events)
+				continue
+			}
+
+			userSubscriptions, ok := hub.subscriptions[subscription.UserID]
+			if !ok {
+				userSubscriptions = make(map[*Subscription]struct{})
+				hub.subscriptions[subscription.UserID] = userSubscriptions
+			}
+			userSubscriptions[subscription] = struct{}{}
+		case subscription := <-hub.unsubscribeChannel:
+			hub.removeSubscription(subscription)
+		case <-hub.closeChannel:
+			for _, userSubscriptions := range hub.subscriptions {
+				for subscription := range userSubscriptions {
+					hub.removeSubscription(subscription)
+				}
+			}
+			hub.closed = true
+			//A closed channel is always ready, so it must not be selected on again
+			hub.closeChannel = nil
+		case event := <-hub.publishChannel:
+			for subscription := range hub.subscriptions[event.UserID] {
+				select {
+				case subscription.events <- event:
+				default:
+					//This subscriber can't keep up. Rather than block every other subscriber, we drop it; it can reconnect and catch up.
+					hub.logger.WithField("user", event.UserID).Warn("Dropping slow event subscriber")
+					hub.removeSubscription(subscription)
+				}
+			}
+		}
+	}
+}
+
+//removeSubscription removes a subscription from the hub and closes its event channel. Removing a subscription that has already been removed has no effect.
+func (hub *Hub) removeSubscription(subscription *Subscription) {
+	userSubscriptions := hub.subscriptions[subscription.UserID]
+	if _, ok := userSubscriptions[subscription]; !ok {
+		return
+	}
+
+	delete(userSubscriptions, subscription)
+	if len(userSubscriptions) == 0 {
+		delete(hub.subscriptions, subscription.UserID)
+	}
+
+	close(subscription.events)
+}
+
+//Events returns the channel that the subscription's events are sent on.
+//The channel is closed when the subscription is closed, or when it was dropped for falling behind.
+func (subscription *Subscription) Events() <-chan Event {
+	return subscription.events
+}
+
+//Close stops the subscription from receiving any more events.
+func (subscription *Subscription) Close() {
+	subscription.hub.unsubscribeChannel <- subscription
+}
@@ -0,0 +1,225 @@
+package fcmhttp
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+//messagingScope is the OAuth2 scope needed to send messages with FCM
+const messagingScope = "https://www.googleapis.com/auth/firebase.messaging"
+
+//jwtBearerGrantType is the OAuth2 grant type for exchanging a signed JWT for an access token
+const jwtBearerGrantType = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+
+//assertionLifetime is how long a signed JWT is valid for. Google allows at most an hour.
+const assertionLifetime = time.Hour
+
+//tokenExpiryMargin is how long before its expiry an access token is replaced, so that it doesn't expire mid-request
+const tokenExpiryMargin = time.Minute
+
+//ServiceAccount holds the parts of a Google service account JSON key needed to authorize with FCM
+type ServiceAccount struct {
+	ProjectID    string `json:"project_id"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	TokenURI     string `json:"token_uri"`
+}
+
+//LoadServiceAccount reads a service account JSON key from the given path
+func LoadServiceAccount(path string) (ServiceAccount, error) {
+	rawAccount, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ServiceAccount{}, err
+	}
+
+	var account ServiceAccount
+	err = json.Unmarshal(rawAccount, &account)
+	if err != nil {
+		return ServiceAccount{}, err
+	}
+
+	if account.ClientEmail == "" || account.PrivateKey == "" {
+		return ServiceAccount{}, errors.New("fcmhttp: service account is missing its client_email or private_key")
+	}
+
+	return account, nil
+}
+
+//tokenSource gets OAuth2 access tokens for a service account, with the two-legged JWT flow. Tokens are cached until shortly before they expire.
+type tokenSource struct {
+	httpClient  *http.Client
+	clientEmail string
+	keyID       string
+	key         *rsa.PrivateKey
+	tokenURL    string
+	token       string
+	expiry      time.Time
+	mux         sync.Mutex
+}
+
+func newTokenSource(httpClient *http.Client, account ServiceAccount, tokenURL string) (*tokenSource, error) {
+	key, err := parsePrivateKey(account.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if tokenURL == "" {
+		tokenURL = account.TokenURI
+	}
+	if tokenURL == "" {
+		return nil, errors.New("fcmhttp: no token url given, and the service account has no token_uri")
+	}
+
+	return &tokenSource{
+		httpClient:  httpClient,
+		clientEmail: account.ClientEmail,
+		keyID:       account.PrivateKeyID,
+		key:         key,
+		tokenURL:    tokenURL,
+	}, nil
+}
+
+//parsePrivateKey parses a PEM encoded RSA key, as found in service account keys
+func parsePrivateKey(pemKey string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return nil, errors.New("fcmhttp: private key is not PEM encoded")
+	}
+
+	//Service account keys are PKCS #8, but PKCS #1 keys are accepted as well.
+	parsedKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+
+	key, ok := parsedKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("fcmhttp: private key is not an RSA key")
+	}
+
+	return key, nil
+}
+
+//Token gets an access token, fetching a new one if the cached one is about to expire
+func (source *tokenSource) Token() (string, error) {
+	source.mux.Lock()
+	defer source.mux.Unlock()
+
+	if source.token != "" && time.Now().Add(tokenExpiryMargin).Before(source.expiry) {
+		return source.token, nil
+	}
+
+	token, expiry, err := source.fetchToken()
+	if err != nil {
+		return "", err
+	}
+
+	source.token = token
+	source.expiry = expiry
+
+	return token, nil
+}
+
+//Invalidate discards the cached token, such as when FCM has rejected it
+func (source *tokenSource) Invalidate() {
+	source.mux.Lock()
+	defer source.mux.Unlock()
+
+	source.token = ""
+}
+
+//fetchToken exchanges a freshly signed JWT for an access token
+func (source *tokenSource) fetchToken() (string, time.Time, error) {
+	assertion, err := source.signAssertion(time.Now())
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	res, err := source.httpClient.PostForm(source.tokenURL, url.Values{
+		"grant_type": {jwtBearerGrantType},
+		"assertion":  {assertion},
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		return "", time.Time{}, fmt.Errorf("fcmhttp: token request failed with status %d: %s", res.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	tokenResponse := struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&tokenResponse)
+	if err != nil {
+		return "", time.Time{}, err
+	} else if tokenResponse.AccessToken == "" {
+		return "", time.Time{}, errors.New("fcmhttp: token response had no access token")
+	}
+
+	expiry := time.Now().Add(time.Duration(tokenResponse.ExpiresIn) * time.Second)
+
+	return tokenResponse.AccessToken, expiry, nil
+}
+
+//signAssertion makes a JWT, signed with RS256, that asserts the service account wants to use FCM
+func (source *tokenSource) signAssertion(now time.Time) (string, error) {
+	header := struct {
+		Algorithm string `json:"alg"`
+		Type      string `json:"typ"`
+		KeyID     string `json:"kid,omitempty"`
+	}{"RS256", "JWT", source.keyID}
+	claims := struct {
+		Issuer    string `json:"iss"`
+		Scope     string `json:"scope"`
+		Audience  string `json:"aud"`
+		IssuedAt  int64  `json:"iat"`
+		ExpiresAt int64  `json:"exp"`
+	}{source.clientEmail, messagingScope, source.tokenURL, now.Unix(), now.Add(assertionLifetime).Unix()}
+
+	encodedHeader, err := encodeJWTSegment(header)
+	if err != nil {
+		return "", err
+	}
+
+	encodedClaims, err := encodeJWTSegment(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := encodedHeader + "." + encodedClaims
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, source.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func encodeJWTSegment(value interface{}) (string, error) {
+	marshaledValue, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(marshaledValue), nil
+}
@@ -0,0 +1,357 @@
+//Package fcmhttp sends downstream messages with the FCM HTTP v1 API, as an alternative to the XMPP connection server. See https://firebase.google.com/docs/reference/fcm/rest/v1/projects.messages/send
+package fcmhttp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ollien/sms-pusher/server/config"
+	"github.com/ollien/sms-pusher/server/firebasexmpp"
+)
+
+const defaultEndpoint = "https://fcm.googleapis.com"
+
+//requestTimeout is how long a single send may take before it is given up on
+const requestTimeout = 30 * time.Second
+
+//Error codes that FCM may give in the details of a failed send. See https://firebase.google.com/docs/reference/fcm/rest/v1/ErrorCode
+const (
+	UnregisteredError     = "UNREGISTERED"
+	InvalidArgumentError  = "INVALID_ARGUMENT"
+	SenderIDMismatchError = "SENDER_ID_MISMATCH"
+	QuotaExceededError    = "QUOTA_EXCEEDED"
+	UnavailableError      = "UNAVAILABLE"
+	InternalError         = "INTERNAL"
+	ThirdPartyAuthError   = "THIRD_PARTY_AUTH_ERROR"
+)
+
+//fcmErrorDetailType is the type of the error detail that holds FCM's error code
+const fcmErrorDetailType = "type.googleapis.com/google.firebase.fcm.v1.FcmError"
+
+//unauthenticatedStatus is the status given when our access token is not accepted
+const unauthenticatedStatus = "UNAUTHENTICATED"
+
+//Sender sends downstream payloads with the FCM HTTP v1 API. It takes payloads from the same send channel, and reports on the same delivery channel, as a firebasexmpp.FirebaseClient, so that either may be used.
+//FCM's errors are translated to their XMPP equivalents, so that payloads are retried, and registration ids cleared, in the same way.
+type Sender struct {
+	httpClient      *http.Client
+	sendURL         string
+	tokens          *tokenSource
+	sendChannel     <-chan firebasexmpp.DownstreamPayload
+	deliveryChannel chan<- firebasexmpp.DeliveryUpdate
+	retryScheduler  *firebasexmpp.RetryScheduler
+	stopChannel     chan struct{}
+	listeners       *sync.WaitGroup
+}
+
+//sendError is an error response from FCM
+type sendError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Status  string `json:"status"`
+	Details []struct {
+		Type      string `json:"@type"`
+		ErrorCode string `json:"errorCode"`
+	} `json:"details"`
+}
+
+//NewSender creates a Sender from the given FCMHTTPConfig.
+//Payloads that FCM rejects with a retryable error are re-sent by retryScheduler.
+func NewSender(httpConfig config.FCMHTTPConfig, sendChannel <-chan firebasexmpp.DownstreamPayload, deliveryChannel chan<- firebasexmpp.DeliveryUpdate, retryScheduler *firebasexmpp.RetryScheduler) (*Sender, error) {
+	account, err := LoadServiceAccount(httpConfig.ServiceAccountFile)
+	if err != nil {
+		return nil, err
+	}
+
+	projectID := httpConfig.ProjectID
+	if projectID == "" {
+		projectID = account.ProjectID
+	}
+	if projectID == "" {
+		return nil, errors.New("fcmhttp: no project id given, and the service account has no project_id")
+	}
+
+	endpoint := httpConfig.Endpoint
+	if endpoint == "" {
+		endpoint = defaultEndpoint
+	}
+
+	httpClient := &http.Client{Timeout: requestTimeout}
+	tokens, err := newTokenSource(httpClient, account, httpConfig.TokenURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Sender{
+		httpClient:      httpClient,
+		sendURL:         fmt.Sprintf("%s/v1/projects/%s/messages:send", strings.TrimRight(endpoint, "/"), projectID),
+		tokens:          tokens,
+		sendChannel:     sendChannel,
+		deliveryChannel: deliveryChannel,
+		retryScheduler:  retryScheduler,
+		stopChannel:     make(chan struct{}),
+		listeners:       &sync.WaitGroup{},
+	}, nil
+}
+
+//Start starts senderCount goroutines that each listen for messages on sendChannel and send them, one at a time. The outcome of every send is reported on deliveryChannel.
+//They run until sendChannel is closed or Stop is called. Start must only be called once.
+func (sender *Sender) Start(senderCount int) {
+	//The goroutines are counted before they are started, so that Stop can never miss one that hasn't started yet
+	sender.listeners.Add(senderCount)
+	for i := 0; i < senderCount; i++ {
+		go sender.listenForSend()
+	}
+}
+
+//listenForSend listens for a message on sendChannel and sends the message.
+//Terminates when sendChannel is closed, or once Stop is called and the send in progress, if any, is done.
+func (sender *Sender) listenForSend() {
+	defer sender.listeners.Done()
+	for {
+		var payload firebasexmpp.DownstreamPayload
+		select {
+		case <-sender.stopChannel:
+			return
+		case nextPayload, ok := <-sender.sendChannel:
+			if !ok {
+				return
+			}
+			payload = nextPayload
+		}
+
+		sender.retryScheduler.Track(payload)
+		sender.reportDelivery(firebasexmpp.DeliveryUpdate{
+			MessageID: payload.MessageID,
+			Status:    firebasexmpp.SentStatus,
+		})
+
+		fcmErr, err := sender.send(payload)
+		if err != nil {
+			sender.retryScheduler.Forget(payload.MessageID)
+			sender.reportDelivery(firebasexmpp.DeliveryUpdate{
+				MessageID: payload.MessageID,
+				Status:    firebasexmpp.SendFailedStatus,
+				Err:       err,
+			})
+		} else if fcmErr != nil {
+			sender.handleSendError(payload, *fcmErr)
+		} else {
+			sender.retryScheduler.Forget(payload.MessageID)
+			sender.reportDelivery(firebasexmpp.DeliveryUpdate{
+				MessageID: payload.MessageID,
+				Status:    firebasexmpp.ACKStatus,
+			})
+		}
+	}
+}
+
+//Stop stops every goroutine started by Start from taking new payloads, blocking until the sends in progress are done and reported, or ctx expires.
+//Payloads that were not taken are left for whatever else listens on sendChannel; their messages remain in the outbox if nothing does. Stop must only be called once, after Start.
+func (sender *Sender) Stop(ctx context.Context) error {
+	close(sender.stopChannel)
+	doneChannel := make(chan struct{})
+	go func() {
+		sender.listeners.Wait()
+		close(doneChannel)
+	}()
+
+	select {
+	case <-doneChannel:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//send sends a payload to FCM. If FCM rejects it, the error it gave is returned; err is only set if the request could not be made at all.
+func (sender *Sender) send(payload firebasexmpp.DownstreamPayload) (*sendError, error) {
+	message, err := makeMessage(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := sender.tokens.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, sender.sendURL, bytes.NewReader(message))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := sender.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusOK {
+		return nil, nil
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	errorResponse := struct {
+		Error sendError `json:"error"`
+	}{}
+	err = json.Unmarshal(body, &errorResponse)
+	if err != nil || errorResponse.Error.Code == 0 {
+		//Not every failure comes from FCM itself, such as those from a proxy, so make do with the status code.
+		return &sendError{Code: res.StatusCode, Message: strings.TrimSpace(string(body))}, nil
+	}
+
+	return &errorResponse.Error, nil
+}
+
+//handleSendError reports a payload that FCM rejected, scheduling it to be sent again if possible
+func (sender *Sender) handleSendError(payload firebasexmpp.DownstreamPayload, fcmErr sendError) {
+	if fcmErr.Code == http.StatusUnauthorized || fcmErr.Status == unauthenticatedStatus {
+		//Our token was revoked or expired early. The next send will get a new one.
+		sender.tokens.Invalidate()
+	}
+
+	nack := firebasexmpp.NACKMessage{
+		From:             payload.To,
+		MessageID:        payload.MessageID,
+		Error:            getNACKError(fcmErr),
+		ErrorDescription: fcmErr.Message,
+	}
+	update := firebasexmpp.DeliveryUpdate{
+		MessageID:        nack.MessageID,
+		Status:           firebasexmpp.NACKStatus,
+		RegistrationID:   nack.From,
+		ErrorCode:        nack.Error,
+		ErrorDescription: nack.ErrorDescription,
+	}
+	if sender.retryScheduler.HandleNACK(nack) {
+		update.Status = firebasexmpp.RetryingStatus
+	}
+
+	sender.reportDelivery(update)
+}
+
+//getNACKError converts an error from FCM into the error code the XMPP connection server would have NACKed with
+func getNACKError(fcmErr sendError) string {
+	errorCode := fcmErr.Status
+	for _, detail := range fcmErr.Details {
+		if detail.Type == fcmErrorDetailType && detail.ErrorCode != "" {
+			errorCode = detail.ErrorCode
+		}
+	}
+
+	switch errorCode {
+	case UnregisteredError:
+		return firebasexmpp.DeviceUnregisteredError
+	case SenderIDMismatchError:
+		//The registration id belongs to another sender, so it will never work for us
+		return firebasexmpp.BadRegistrationError
+	case InvalidArgumentError:
+		return firebasexmpp.InvalidJSONError
+	case QuotaExceededError:
+		return firebasexmpp.DeviceMessageRateExceededError
+	case UnavailableError, unauthenticatedStatus:
+		return firebasexmpp.ServiceUnavailableError
+	case InternalError:
+		return firebasexmpp.InternalServerError
+	}
+
+	switch {
+	case fcmErr.Code == http.StatusUnauthorized:
+		return firebasexmpp.ServiceUnavailableError
+	case fcmErr.Code == http.StatusTooManyRequests:
+		return firebasexmpp.DeviceMessageRateExceededError
+	case fcmErr.Code >= http.StatusInternalServerError:
+		return firebasexmpp.ServiceUnavailableError
+	case errorCode != "":
+		return errorCode
+	default:
+		return fmt.Sprintf("HTTP_%d", fcmErr.Code)
+	}
+}
+
+//makeMessage converts a payload for the legacy API into the body of an HTTP v1 send request
+func makeMessage(payload firebasexmpp.DownstreamPayload) ([]byte, error) {
+	data, err := makeDataMap(payload.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	type androidConfig struct {
+		CollapseKey string `json:"collapse_key,omitempty"`
+		Priority    string `json:"priority,omitempty"`
+		TTL         string `json:"ttl,omitempty"`
+	}
+	android := androidConfig{
+		CollapseKey: payload.CollapseKey,
+		Priority:    strings.ToUpper(payload.Priority),
+	}
+	if payload.TTL != 0 {
+		android.TTL = fmt.Sprintf("%ds", payload.TTL)
+	}
+
+	message := struct {
+		ValidateOnly bool `json:"validate_only,omitempty"`
+		Message      struct {
+			Token     string            `json:"token,omitempty"`
+			Condition string            `json:"condition,omitempty"`
+			Data      map[string]string `json:"data,omitempty"`
+			Android   androidConfig     `json:"android"`
+		} `json:"message"`
+	}{ValidateOnly: payload.DryRun}
+	message.Message.Token = payload.To
+	message.Message.Condition = payload.Condition
+	message.Message.Data = data
+	message.Message.Android = android
+
+	return json.Marshal(message)
+}
+
+//makeDataMap flattens a payload's data into the string to string map that the HTTP v1 API requires. Values that aren't strings are JSON encoded.
+func makeDataMap(data interface{}) (map[string]string, error) {
+	if data == nil {
+		return nil, nil
+	}
+
+	marshaledData, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(marshaledData, &fields)
+	if err != nil {
+		return nil, fmt.Errorf("fcmhttp: payload data must be an object: %s", err)
+	}
+
+	dataMap := make(map[string]string, len(fields))
+	for key, value := range fields {
+		var stringValue string
+		if json.Unmarshal(value, &stringValue) == nil {
+			dataMap[key] = stringValue
+		} else {
+			dataMap[key] = string(value)
+		}
+	}
+
+	return dataMap, nil
+}
+
+//reportDelivery sends a DeliveryUpdate to the delivery channel. As there is no FirebaseClient involved, Client is always nil.
+func (sender *Sender) reportDelivery(update firebasexmpp.DeliveryUpdate) {
+	sender.deliveryChannel <- update
+}
@@ -0,0 +1,265 @@
+package fcmtest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+const (
+	streamNamespace  = "http://etherx.jabber.org/streams"
+	saslNamespace    = "urn:ietf:params:xml:ns:xmpp-sasl"
+	bindNamespace    = "urn:ietf:params:xml:ns:xmpp-bind"
+	sessionNamespace = "urn:ietf:params:xml:ns:xmpp-session"
+	gcmNamespace     = "google:mobile:data"
+	fcmDomain        = "gcm.googleapis.com"
+)
+
+//errNotAuthorized is returned when a client fails SASL authentication
+var errNotAuthorized = errors.New("fcmtest: not authorized")
+
+//conn is a single client connection to the server
+type conn struct {
+	server   *Server
+	netConn  net.Conn
+	decoder  *xml.Decoder
+	writeMux sync.Mutex
+	//draining is set once CONNECTION_DRAINING has been sent. It is guarded by the server's mutex.
+	draining bool
+}
+
+//authElement is the SASL auth element a client sends to log in
+type authElement struct {
+	Mechanism string `xml:"mechanism,attr"`
+	Value     string `xml:",chardata"`
+}
+
+//iqElement is an iq stanza sent by a client, such as a resource bind
+type iqElement struct {
+	ID   string `xml:"id,attr"`
+	Type string `xml:"type,attr"`
+	Bind *struct {
+		Resource string `xml:"resource"`
+	} `xml:"urn:ietf:params:xml:ns:xmpp-bind bind"`
+}
+
+//messageElement is a message stanza sent by a client, which holds FCM's JSON in its gcm element
+type messageElement struct {
+	GCM struct {
+		Payload string `xml:",chardata"`
+	} `xml:"google:mobile:data gcm"`
+}
+
+func newConn(server *Server, netConn net.Conn) *conn {
+	return &conn{
+		server:  server,
+		netConn: netConn,
+		decoder: xml.NewDecoder(netConn),
+	}
+}
+
+//serve performs the XMPP handshake and then handles stanzas until the connection is closed
+func (c *conn) serve() {
+	defer c.netConn.Close()
+
+	err := c.authenticate()
+	if err != nil {
+		return
+	}
+
+	err = c.bind()
+	if err != nil {
+		return
+	}
+
+	c.server.addConn(c)
+	defer c.server.removeConn(c)
+
+	c.readStanzas()
+}
+
+//authenticate opens the stream and performs SASL PLAIN authentication against the server's sender id and server key
+func (c *conn) authenticate() error {
+	err := c.openStream("<mechanisms xmlns='" + saslNamespace + "'><mechanism>PLAIN</mechanism></mechanisms>")
+	if err != nil {
+		return err
+	}
+
+	start, err := c.nextStart()
+	if err != nil {
+		return err
+	}
+
+	var auth authElement
+	if start.Name.Space != saslNamespace || start.Name.Local != "auth" {
+		return fmt.Errorf("fcmtest: expected auth, got %s", start.Name.Local)
+	}
+	err = c.decoder.DecodeElement(&auth, &start)
+	if err != nil {
+		return err
+	}
+
+	if auth.Mechanism != "PLAIN" || !c.server.checkCredentials(auth.Value) {
+		c.write("<failure xmlns='" + saslNamespace + "'><not-authorized/></failure></stream:stream>")
+		return errNotAuthorized
+	}
+
+	return c.write("<success xmlns='" + saslNamespace + "'/>")
+}
+
+//bind reopens the stream after authentication and binds the client's resource
+func (c *conn) bind() error {
+	err := c.openStream("<bind xmlns='" + bindNamespace + "'/><session xmlns='" + sessionNamespace + "'/>")
+	if err != nil {
+		return err
+	}
+
+	start, err := c.nextStart()
+	if err != nil {
+		return err
+	}
+
+	var iq iqElement
+	if start.Name.Local != "iq" {
+		return fmt.Errorf("fcmtest: expected bind, got %s", start.Name.Local)
+	}
+	err = c.decoder.DecodeElement(&iq, &start)
+	if err != nil {
+		return err
+	}
+	if iq.Bind == nil {
+		return errors.New("fcmtest: expected bind, got another iq")
+	}
+
+	resource := iq.Bind.Resource
+	if resource == "" {
+		resource = "fcmtest"
+	}
+	jid := fmt.Sprintf("%s@%s/%s", c.server.senderID, fcmDomain, resource)
+
+	return c.write("<iq type='result' id='" + escape(iq.ID) + "'><bind xmlns='" + bindNamespace + "'><jid>" + escape(jid) + "</jid></bind></iq>")
+}
+
+//openStream waits for the client to open a stream, and then opens ours with the given features
+func (c *conn) openStream(features string) error {
+	for {
+		start, err := c.nextStart()
+		if err != nil {
+			return err
+		}
+
+		if start.Name.Space == streamNamespace && start.Name.Local == "stream" {
+			break
+		}
+	}
+
+	return c.write("<?xml version='1.0'?>" +
+		"<stream:stream from='" + fcmDomain + "' id='fcmtest' version='1.0' xmlns='jabber:client' xmlns:stream='" + streamNamespace + "'>" +
+		"<stream:features>" + features + "</stream:features>")
+}
+
+//readStanzas handles every stanza from the client until the stream ends
+func (c *conn) readStanzas() {
+	for {
+		start, err := c.nextStart()
+		if err != nil {
+			return
+		}
+
+		switch start.Name.Local {
+		case "message":
+			var message messageElement
+			err = c.decoder.DecodeElement(&message, &start)
+			if err != nil {
+				return
+			}
+			c.server.handleMessage(c, []byte(message.GCM.Payload))
+		case "iq":
+			//The only iqs a client should send once bound are session establishment and pings, both of which just need a result.
+			var iq iqElement
+			err = c.decoder.DecodeElement(&iq, &start)
+			if err != nil {
+				return
+			}
+			c.write("<iq type='result' id='" + escape(iq.ID) + "'/>")
+		default:
+			//Presence, and anything else, is ignored, as it is by FCM.
+			err = c.decoder.Skip()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+//nextStart reads until the next start element. An error is returned if the stream ends first.
+func (c *conn) nextStart() (xml.StartElement, error) {
+	for {
+		token, err := c.decoder.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+
+		switch element := token.(type) {
+		case xml.StartElement:
+			return element, nil
+		case xml.EndElement:
+			if element.Name.Space == streamNamespace && element.Name.Local == "stream" {
+				return xml.StartElement{}, errors.New("fcmtest: stream closed")
+			}
+		}
+	}
+}
+
+//sendJSON sends a message with the given payload to the client in the gcm element FCM uses
+func (c *conn) sendJSON(payload interface{}) error {
+	//encoding/json escapes <, > and &, so the marshaled payload is always safe to put in XML as is.
+	marshaledPayload, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	return c.write("<message><gcm xmlns='" + gcmNamespace + "'>" + string(marshaledPayload) + "</gcm></message>")
+}
+
+func (c *conn) write(data string) error {
+	c.writeMux.Lock()
+	defer c.writeMux.Unlock()
+
+	_, err := c.netConn.Write([]byte(data))
+
+	return err
+}
+
+//checkPlainAuth checks a base64 encoded SASL PLAIN message against the given username and password.
+//The username may be given as either just the sender id, or the full jid.
+func checkPlainAuth(encodedAuth string, username string, password string) bool {
+	rawAuth, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encodedAuth))
+	if err != nil {
+		return false
+	}
+
+	//PLAIN is authzid, authcid and password, separated by NUL
+	parts := bytes.Split(rawAuth, []byte{0})
+	if len(parts) != 3 {
+		return false
+	}
+
+	givenUsername := strings.TrimSuffix(string(parts[1]), "@"+fcmDomain)
+
+	return givenUsername == username && string(parts[2]) == password
+}
+
+//escape escapes a string for use in XML text or attributes
+func escape(value string) string {
+	var buffer bytes.Buffer
+	xml.EscapeText(&buffer, []byte(value))
+
+	return buffer.String()
+}
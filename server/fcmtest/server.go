@@ -0,0 +1,384 @@
+//Package fcmtest runs a fake Firebase Cloud Messaging XMPP connection server, so that the server can be run end to end without connecting to Google.
+//It speaks just enough XMPP for a go-xmpp client to authenticate with SASL PLAIN, and then speaks FCM's google:mobile:data dialect: downstream messages are ACKed (or NACKed, see Responder), and upstream messages, CONNECTION_DRAINING and abrupt disconnects can be triggered from the test.
+package fcmtest
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ollien/sms-pusher/server/config"
+)
+
+//eventBufferSize is how many downstream messages and upstream ACKs are buffered for the test to read. Any past this are dropped.
+const eventBufferSize = 1024
+
+//upstreamCategory is the app package name upstream messages claim to come from
+const upstreamCategory = "com.example.fcmtest"
+
+//receiptMessagePrefix is prepended to the ids of delivery receipts, as FCM does
+const receiptMessagePrefix = "dr2:"
+
+//ErrNoConnections is returned when a message must be sent to a client, but none are connected
+var ErrNoConnections = errors.New("fcmtest: no connected clients")
+
+//DownstreamMessage is a message that a client has sent downstream
+type DownstreamMessage struct {
+	To                       string          `json:"to"`
+	MessageID                string          `json:"message_id"`
+	DeliveryReceiptRequested bool            `json:"delivery_receipt_requested"`
+	Data                     json.RawMessage `json:"data"`
+}
+
+//Response is how the server responds to a downstream message
+type Response struct {
+	//NACKError NACKs the message with the given error code, such as BAD_REGISTRATION, rather than ACKing it
+	NACKError       string
+	NACKDescription string
+	//NoReceipt prevents a delivery receipt from being sent for an ACKed message that requested one
+	NoReceipt bool
+	//Ignore leaves the message unACKed
+	Ignore bool
+}
+
+//Responder decides how the server responds to each downstream message
+type Responder func(message DownstreamMessage) Response
+
+//Server is a fake FCM XMPP connection server, listening on a random local port.
+type Server struct {
+	senderID  string
+	serverKey string
+	listener  net.Listener
+	//caFile holds the server's certificate, so that it may be trusted by clients
+	caFile    string
+	responder Responder
+	conns     []*conn
+	//netConns holds every open connection, including those still authenticating, so that they may be closed with the server
+	netConns     map[net.Conn]struct{}
+	downstream   chan DownstreamMessage
+	upstreamACKs chan string
+	mux          sync.Mutex
+	waitGroup    sync.WaitGroup
+}
+
+//NewServer starts a new Server that accepts clients authenticating with the given sender id and server key.
+//By default, every downstream message is ACKed, and receipts are sent for those that request them.
+func NewServer(senderID string, serverKey string) (*Server, error) {
+	certificate, pemCert, err := generateCertificate()
+	if err != nil {
+		return nil, err
+	}
+
+	caFile, err := ioutil.TempFile("", "fcmtest-ca")
+	if err != nil {
+		return nil, err
+	}
+	_, err = caFile.Write(pemCert)
+	caFile.Close()
+	if err != nil {
+		os.Remove(caFile.Name())
+		return nil, err
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{certificate}})
+	if err != nil {
+		os.Remove(caFile.Name())
+		return nil, err
+	}
+
+	server := &Server{
+		senderID:     senderID,
+		serverKey:    serverKey,
+		listener:     listener,
+		caFile:       caFile.Name(),
+		responder:    ackEverything,
+		netConns:     make(map[net.Conn]struct{}),
+		downstream:   make(chan DownstreamMessage, eventBufferSize),
+		upstreamACKs: make(chan string, eventBufferSize),
+	}
+	server.waitGroup.Add(1)
+	go server.acceptConnections()
+
+	return server, nil
+}
+
+//ackEverything is the default Responder
+func ackEverything(message DownstreamMessage) Response {
+	return Response{}
+}
+
+//XMPPConfig gets an XMPPConfig that connects to this server
+func (server *Server) XMPPConfig() config.XMPPConfig {
+	address := server.listener.Addr().(*net.TCPAddr)
+
+	return config.XMPPConfig{
+		SenderID:    server.senderID,
+		ServerKey:   server.serverKey,
+		Environment: config.DevelopmentEnvironment,
+		Host:        address.IP.String(),
+		Port:        address.Port,
+		TLS: config.XMPPTLSConfig{
+			CAFile: server.caFile,
+		},
+	}
+}
+
+//SetResponder sets how the server responds to downstream messages
+func (server *Server) SetResponder(responder Responder) {
+	server.mux.Lock()
+	defer server.mux.Unlock()
+
+	server.responder = responder
+}
+
+//Downstream gets the channel that every downstream message sent by a client is sent on, after it has been responded to.
+func (server *Server) Downstream() <-chan DownstreamMessage {
+	return server.downstream
+}
+
+//UpstreamACKs gets the channel that the message ids of ACKed upstream messages are sent on
+func (server *Server) UpstreamACKs() <-chan string {
+	return server.upstreamACKs
+}
+
+//ConnectionCount gets the number of connected clients, including those that are draining
+func (server *Server) ConnectionCount() int {
+	server.mux.Lock()
+	defer server.mux.Unlock()
+
+	return len(server.conns)
+}
+
+//WaitForConnections waits until at least count clients are connected and not draining. Returns an error if this does not happen within timeout.
+func (server *Server) WaitForConnections(count int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if len(server.activeConns()) >= count {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return errors.New("fcmtest: timed out waiting for connections")
+}
+
+//SendUpstream sends an upstream message from the device with the given registration id to the most recently connected client that is not draining.
+func (server *Server) SendUpstream(from string, messageID string, data interface{}) error {
+	conns := server.activeConns()
+	if len(conns) == 0 {
+		return ErrNoConnections
+	}
+
+	return conns[len(conns)-1].sendJSON(struct {
+		Category  string      `json:"category"`
+		Data      interface{} `json:"data"`
+		MessageID string      `json:"message_id"`
+		From      string      `json:"from"`
+		TTL       int         `json:"time_to_live"`
+	}{upstreamCategory, data, messageID, from, 86400})
+}
+
+//Drain sends CONNECTION_DRAINING to every connected client. Clients that have been drained stay connected until they disconnect, or Disconnect is called, but are not sent upstream messages.
+func (server *Server) Drain() error {
+	conns := server.activeConns()
+	if len(conns) == 0 {
+		return ErrNoConnections
+	}
+
+	server.mux.Lock()
+	for _, c := range conns {
+		c.draining = true
+	}
+	server.mux.Unlock()
+
+	for _, c := range conns {
+		err := c.sendJSON(struct {
+			MessageType string `json:"message_type"`
+			ControlType string `json:"control_type"`
+		}{"control", "CONNECTION_DRAINING"})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//Disconnect abruptly closes every client connection, without closing the XMPP stream.
+func (server *Server) Disconnect() {
+	server.mux.Lock()
+	defer server.mux.Unlock()
+
+	for _, c := range server.conns {
+		c.netConn.Close()
+	}
+}
+
+//Close stops the server and disconnects all clients
+func (server *Server) Close() error {
+	err := server.listener.Close()
+	server.mux.Lock()
+	for netConn := range server.netConns {
+		netConn.Close()
+	}
+	server.mux.Unlock()
+
+	server.waitGroup.Wait()
+	os.Remove(server.caFile)
+
+	return err
+}
+
+//acceptConnections serves every client that connects, until the listener is closed
+func (server *Server) acceptConnections() {
+	defer server.waitGroup.Done()
+	for {
+		netConn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		server.mux.Lock()
+		server.netConns[netConn] = struct{}{}
+		server.mux.Unlock()
+
+		server.waitGroup.Add(1)
+		go func() {
+			defer server.waitGroup.Done()
+			newConn(server, netConn).serve()
+
+			server.mux.Lock()
+			delete(server.netConns, netConn)
+			server.mux.Unlock()
+		}()
+	}
+}
+
+//activeConns gets the connected clients that are not draining, in the order they connected
+func (server *Server) activeConns() []*conn {
+	server.mux.Lock()
+	defer server.mux.Unlock()
+
+	conns := make([]*conn, 0, len(server.conns))
+	for _, c := range server.conns {
+		if !c.draining {
+			conns = append(conns, c)
+		}
+	}
+
+	return conns
+}
+
+func (server *Server) addConn(c *conn) {
+	server.mux.Lock()
+	defer server.mux.Unlock()
+
+	server.conns = append(server.conns, c)
+}
+
+func (server *Server) removeConn(c *conn) {
+	server.mux.Lock()
+	defer server.mux.Unlock()
+
+	for i, existingConn := range server.conns {
+		if existingConn == c {
+			server.conns = append(server.conns[:i], server.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+func (server *Server) checkCredentials(encodedAuth string) bool {
+	return checkPlainAuth(encodedAuth, server.senderID, server.serverKey)
+}
+
+//handleMessage handles the JSON payload of a message sent by a client
+func (server *Server) handleMessage(c *conn, payload []byte) {
+	message := struct {
+		DownstreamMessage
+		MessageType string `json:"message_type"`
+	}{}
+	err := json.Unmarshal(payload, &message)
+	if err != nil {
+		return
+	}
+
+	switch message.MessageType {
+	case "":
+		server.handleDownstream(c, message.DownstreamMessage)
+	case "ack":
+		//Receipts must be ACKed too, but the test only cares about the upstream messages it sent
+		if !strings.HasPrefix(message.MessageID, receiptMessagePrefix) {
+			select {
+			case server.upstreamACKs <- message.MessageID:
+			default:
+			}
+		}
+	}
+}
+
+//handleDownstream responds to a downstream message as the responder dictates
+func (server *Server) handleDownstream(c *conn, message DownstreamMessage) {
+	server.mux.Lock()
+	responder := server.responder
+	server.mux.Unlock()
+
+	response := responder(message)
+	switch {
+	case response.Ignore:
+	case response.NACKError != "":
+		c.sendJSON(struct {
+			MessageType      string `json:"message_type"`
+			From             string `json:"from"`
+			MessageID        string `json:"message_id"`
+			Error            string `json:"error"`
+			ErrorDescription string `json:"error_description"`
+		}{"nack", message.To, message.MessageID, response.NACKError, response.NACKDescription})
+	default:
+		c.sendJSON(struct {
+			MessageType string `json:"message_type"`
+			From        string `json:"from"`
+			MessageID   string `json:"message_id"`
+		}{"ack", message.To, message.MessageID})
+
+		if message.DeliveryReceiptRequested && !response.NoReceipt {
+			server.sendReceipt(c, message)
+		}
+	}
+
+	select {
+	case server.downstream <- message:
+	default:
+	}
+}
+
+//sendReceipt sends a delivery receipt for the given message, as FCM would once the device received it
+func (server *Server) sendReceipt(c *conn, message DownstreamMessage) error {
+	receipt := struct {
+		MessageType string `json:"message_type"`
+		MessageID   string `json:"message_id"`
+		From        string `json:"from"`
+		Category    string `json:"category"`
+		Data        struct {
+			MessageStatus        string `json:"message_status"`
+			OriginalMessageID    string `json:"original_message_id"`
+			DeviceRegistrationID string `json:"device_registration_id"`
+		} `json:"data"`
+	}{
+		MessageType: "receipt",
+		MessageID:   receiptMessagePrefix + message.MessageID,
+		From:        fcmDomain,
+		Category:    upstreamCategory,
+	}
+	receipt.Data.MessageStatus = "MESSAGE_SENT_TO_DEVICE"
+	receipt.Data.OriginalMessageID = message.MessageID
+	receipt.Data.DeviceRegistrationID = message.To
+
+	return c.sendJSON(receipt)
+}
@@ -0,0 +1,361 @@
+package fcmtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ollien/sms-pusher/server/firebasexmpp"
+)
+
+const (
+	testSenderID  = "123456789"
+	testServerKey = "test-server-key"
+	//testTimeout is how long to wait for anything to come from the server or the client
+	testTimeout = 5 * time.Second
+	//channelBufferSize is large enough that nothing in a test ever blocks on a full channel
+	channelBufferSize = 64
+)
+
+//testClients connects FirebaseClients to a test Server. Like the supervisor, every client shares the same channels, retry scheduler and upstream cache.
+type testClients struct {
+	server         *Server
+	retryScheduler *firebasexmpp.RetryScheduler
+	upstreamCache  *firebasexmpp.UpstreamCache
+	recv           chan firebasexmpp.UpstreamMessage
+	send           chan firebasexmpp.DownstreamPayload
+	deliveries     chan firebasexmpp.DeliveryUpdate
+	signals        chan firebasexmpp.Signal
+	errors         chan firebasexmpp.ClientError
+}
+
+func newTestServer(t *testing.T) *Server {
+	server, err := NewServer(testSenderID, testServerKey)
+	if err != nil {
+		t.Fatalf("could not start server: %s", err)
+	}
+	t.Cleanup(func() {
+		server.Close()
+	})
+
+	return server
+}
+
+func newTestClients(server *Server) *testClients {
+	send := make(chan firebasexmpp.DownstreamPayload, channelBufferSize)
+
+	return &testClients{
+		server:         server,
+		retryScheduler: firebasexmpp.NewRetryScheduler(send),
+		upstreamCache:  firebasexmpp.NewUpstreamCache(firebasexmpp.DefaultUpstreamCacheSize),
+		recv:           make(chan firebasexmpp.UpstreamMessage, channelBufferSize),
+		send:           send,
+		deliveries:     make(chan firebasexmpp.DeliveryUpdate, channelBufferSize),
+		signals:        make(chan firebasexmpp.Signal, channelBufferSize),
+		errors:         make(chan firebasexmpp.ClientError, channelBufferSize),
+	}
+}
+
+//connect connects a new FirebaseClient to the server, and starts it receiving and sending
+func (clients *testClients) connect(t *testing.T) *firebasexmpp.FirebaseClient {
+	t.Helper()
+	connectionCount := clients.server.ConnectionCount()
+	transport, err := firebasexmpp.NewXMPPTransport(clients.server.XMPPConfig())
+	if err != nil {
+		t.Fatalf("could not connect to server: %s", err)
+	}
+
+	client := firebasexmpp.NewFirebaseClient("test", transport, clients.recv, clients.send, clients.deliveries, clients.retryScheduler, clients.upstreamCache, clients.signals, clients.errors)
+	go client.StartRecv()
+	go client.ListenForSend()
+	t.Cleanup(func() {
+		client.Close()
+	})
+
+	//The server only counts the client once it has been bound, which may happen after go-xmpp returns
+	deadline := time.Now().Add(testTimeout)
+	for clients.server.ConnectionCount() <= connectionCount {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the client to be connected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return &client
+}
+
+//waitForStatus waits for a DeliveryUpdate with the given status for the given message, skipping any others
+func (clients *testClients) waitForStatus(t *testing.T, messageID string, status firebasexmpp.DeliveryStatus) firebasexmpp.DeliveryUpdate {
+	t.Helper()
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case update := <-clients.deliveries:
+			if update.MessageID == messageID && update.Status == status {
+				return update
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for status %d of %s", status, messageID)
+		}
+	}
+}
+
+//waitForSignal waits for a Signal of the given type, skipping any others
+func (clients *testClients) waitForSignal(t *testing.T, signalType firebasexmpp.SignalType) {
+	t.Helper()
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case signal := <-clients.signals:
+			if signal.Type == signalType {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for signal %d", signalType)
+		}
+	}
+}
+
+func waitForDownstream(t *testing.T, server *Server) DownstreamMessage {
+	t.Helper()
+	select {
+	case message := <-server.Downstream():
+		return message
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for a downstream message")
+	}
+
+	return DownstreamMessage{}
+}
+
+func waitForUpstreamACK(t *testing.T, server *Server) string {
+	t.Helper()
+	select {
+	case messageID := <-server.UpstreamACKs():
+		return messageID
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for an upstream ACK")
+	}
+
+	return ""
+}
+
+func (clients *testClients) waitForUpstream(t *testing.T) firebasexmpp.UpstreamMessage {
+	t.Helper()
+	select {
+	case message := <-clients.recv:
+		return message
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for an upstream message")
+	}
+
+	return firebasexmpp.UpstreamMessage{}
+}
+
+func TestWrongServerKeyFailsAuthentication(t *testing.T) {
+	server := newTestServer(t)
+	xmppConfig := server.XMPPConfig()
+	xmppConfig.ServerKey = "wrong"
+
+	_, err := firebasexmpp.NewXMPPTransport(xmppConfig)
+	if err == nil {
+		t.Fatal("expected authentication to fail")
+	}
+	if server.ConnectionCount() != 0 {
+		t.Fatalf("expected no connections, got %d", server.ConnectionCount())
+	}
+}
+
+func TestDownstreamMessageIsACKed(t *testing.T) {
+	server := newTestServer(t)
+	clients := newTestClients(server)
+	client := clients.connect(t)
+
+	clients.send <- firebasexmpp.DownstreamPayload{To: "device", MessageID: "ack-me", Data: map[string]string{"hello": "world"}}
+
+	clients.waitForStatus(t, "ack-me", firebasexmpp.SentStatus)
+	clients.waitForStatus(t, "ack-me", firebasexmpp.ACKStatus)
+	message := waitForDownstream(t, server)
+	if message.To != "device" || message.MessageID != "ack-me" || string(message.Data) != `{"hello":"world"}` {
+		t.Fatalf("unexpected downstream message %+v", message)
+	}
+	if client.InFlightCount() != 0 {
+		t.Fatalf("expected nothing in flight, got %d", client.InFlightCount())
+	}
+}
+
+func TestResponderNACKsDownstreamMessage(t *testing.T) {
+	server := newTestServer(t)
+	server.SetResponder(func(message DownstreamMessage) Response {
+		return Response{NACKError: firebasexmpp.BadRegistrationError, NACKDescription: "bad registration"}
+	})
+	clients := newTestClients(server)
+	clients.connect(t)
+
+	clients.send <- firebasexmpp.DownstreamPayload{To: "device", MessageID: "nack-me"}
+
+	update := clients.waitForStatus(t, "nack-me", firebasexmpp.NACKStatus)
+	if update.ErrorCode != firebasexmpp.BadRegistrationError || update.RegistrationID != "device" {
+		t.Fatalf("unexpected NACK %+v", update)
+	}
+}
+
+func TestRetryableNACKIsRetried(t *testing.T) {
+	server := newTestServer(t)
+	//The responder is only ever called by the one client's connection, so it needs no locking
+	nacked := false
+	server.SetResponder(func(message DownstreamMessage) Response {
+		if !nacked {
+			nacked = true
+			return Response{NACKError: firebasexmpp.ServiceUnavailableError}
+		}
+
+		return Response{}
+	})
+	clients := newTestClients(server)
+	clients.connect(t)
+
+	clients.send <- firebasexmpp.DownstreamPayload{To: "device", MessageID: "retry-me"}
+
+	clients.waitForStatus(t, "retry-me", firebasexmpp.RetryingStatus)
+	clients.waitForStatus(t, "retry-me", firebasexmpp.ACKStatus)
+}
+
+func TestDeliveryReceipt(t *testing.T) {
+	server := newTestServer(t)
+	clients := newTestClients(server)
+	clients.connect(t)
+
+	clients.send <- firebasexmpp.DownstreamPayload{To: "device", MessageID: "receipt-me", DeliveryReceiptRequested: true}
+
+	clients.waitForStatus(t, "receipt-me", firebasexmpp.ACKStatus)
+	clients.waitForStatus(t, "receipt-me", firebasexmpp.DeliveredStatus)
+	//The receipt's ACK must not be mistaken for the ACK of an upstream message
+	select {
+	case messageID := <-server.UpstreamACKs():
+		t.Fatalf("unexpected upstream ACK for %s", messageID)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestUpstreamMessageIsPassedOnOnce(t *testing.T) {
+	server := newTestServer(t)
+	clients := newTestClients(server)
+	clients.connect(t)
+
+	err := server.SendUpstream("device", "upstream-1", map[string]string{"message": "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := clients.waitForUpstream(t)
+	if message.From != "device" || message.MessageID != "upstream-1" || string(message.Data) != `{"message":"hi"}` {
+		t.Fatalf("unexpected upstream message %+v", message)
+	}
+	err = message.ACK()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messageID := waitForUpstreamACK(t, server); messageID != "upstream-1" {
+		t.Fatalf("expected ACK for upstream-1, got %s", messageID)
+	}
+
+	//FCM redelivers messages whose ACK it didn't see. They must be ACKed again, but not passed on.
+	err = server.SendUpstream("device", "upstream-1", map[string]string{"message": "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messageID := waitForUpstreamACK(t, server); messageID != "upstream-1" {
+		t.Fatalf("expected ACK for upstream-1, got %s", messageID)
+	}
+	select {
+	case message := <-clients.recv:
+		t.Fatalf("redelivered message %s was passed on", message.MessageID)
+	default:
+	}
+}
+
+func TestSendUpstreamWithoutClients(t *testing.T) {
+	server := newTestServer(t)
+
+	err := server.SendUpstream("device", "upstream-1", nil)
+	if err != ErrNoConnections {
+		t.Fatalf("expected ErrNoConnections, got %v", err)
+	}
+}
+
+func TestDrainStopsClientSending(t *testing.T) {
+	server := newTestServer(t)
+	clients := newTestClients(server)
+	drainedClient := clients.connect(t)
+
+	err := server.Drain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients.waitForSignal(t, firebasexmpp.ConnectionDrainingSignal)
+
+	//The drained client stays connected, but is no longer sent upstream messages
+	if server.ConnectionCount() != 1 {
+		t.Fatalf("expected the drained client to stay connected, got %d connections", server.ConnectionCount())
+	}
+	err = server.SendUpstream("device", "upstream-1", nil)
+	if err != ErrNoConnections {
+		t.Fatalf("expected ErrNoConnections, got %v", err)
+	}
+
+	//The drained client must not take any more payloads, leaving them for its replacement
+	replacementClient := clients.connect(t)
+	clients.send <- firebasexmpp.DownstreamPayload{To: "device", MessageID: "after-drain"}
+	update := clients.waitForStatus(t, "after-drain", firebasexmpp.ACKStatus)
+	if update.Client != replacementClient {
+		t.Fatal("payload was sent by the drained client")
+	}
+	if drainedClient.InFlightCount() != 0 {
+		t.Fatalf("expected nothing in flight on the drained client, got %d", drainedClient.InFlightCount())
+	}
+
+	err = server.SendUpstream("device", "upstream-2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message := clients.waitForUpstream(t); message.MessageID != "upstream-2" {
+		t.Fatalf("unexpected upstream message %+v", message)
+	}
+}
+
+func TestDisconnectRetriesInFlightPayloads(t *testing.T) {
+	server := newTestServer(t)
+	server.SetResponder(func(message DownstreamMessage) Response {
+		return Response{Ignore: true}
+	})
+	clients := newTestClients(server)
+	clients.connect(t)
+
+	clients.send <- firebasexmpp.DownstreamPayload{To: "device", MessageID: "in-flight"}
+	clients.waitForStatus(t, "in-flight", firebasexmpp.SentStatus)
+	waitForDownstream(t, server)
+
+	//Anything sent from here on is ACKed, so that the retry succeeds once the client has reconnected
+	server.SetResponder(func(message DownstreamMessage) Response {
+		return Response{}
+	})
+	server.Disconnect()
+	clients.waitForSignal(t, firebasexmpp.ConnectionClosedSignal)
+	update := clients.waitForStatus(t, "in-flight", firebasexmpp.RetryingStatus)
+	if update.ErrorCode != firebasexmpp.ConnectionClosedError {
+		t.Fatalf("expected %s, got %s", firebasexmpp.ConnectionClosedError, update.ErrorCode)
+	}
+
+	deadline := time.Now().Add(testTimeout)
+	for server.ConnectionCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the client to disconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	reconnectedClient := clients.connect(t)
+	update = clients.waitForStatus(t, "in-flight", firebasexmpp.ACKStatus)
+	if update.Client != reconnectedClient {
+		t.Fatal("retry was not sent by the reconnected client")
+	}
+}
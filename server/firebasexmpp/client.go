@@ -1,31 +1,30 @@
 package firebasexmpp
 
 import (
-	"fmt"
+	"encoding/json"
 	"io"
-	"strings"
-
-	"github.com/mattn/go-xmpp"
-	"github.com/ollien/sms-pusher/server/config"
+	"sync"
+	"time"
 )
 
-const fcmServer = "fcm-xmpp.googleapis.com"
-const fcmDevPort = 5236
-const fcmProdPort = 5235
-const fcmUsernameAddres = "gcm.googleapis.com"
-
 //FirebaseClient stores the data necessary to be an XMPP Client for Firebase Cloud Messaging. See the spec at https://firebase.google.com/docs/cloud-messaging/xmpp-server-ref
-//senderID and severKey refer to their corresponding FCM properties. ClientID is simply an id to identify clients. It can safely be ommitted, but your connectionClosedCallback will receive an empty string
+//ClientID is simply an id to identify clients. It can safely be ommitted, but your connectionClosedCallback will receive an empty string
 //Note that Signal will recieve pointer types of signals such as *ConnectionDrainingSignal and *ConnectionClosedSignal rather than ConnectionDrainingSignal and ConnectionClosedSignal respectively.
 type FirebaseClient struct {
-	xmppClient    xmpp.Client
-	ClientID      string
-	senderID      string
-	serverKey     string
-	recvChannel   chan<- UpstreamMessage
-	sendChannel   <-chan DownstreamPayload
-	signalChannel chan<- Signal
-	errorChannel  chan<- ClientError
+	ClientID        string
+	transport       Transport
+	recvChannel     chan<- UpstreamMessage
+	sendChannel     <-chan DownstreamPayload
+	deliveryChannel chan<- DeliveryUpdate
+	retryScheduler  *RetryScheduler
+	upstreamCache   *UpstreamCache
+	inFlight        *inFlightWindow
+	signalChannel   chan<- Signal
+	errorChannel    chan<- ClientError
+	//stopSending is closed by StopSending, and stopOnce ensures it only happens once
+	stopSending chan struct{}
+	stopOnce    *sync.Once
+	closeOnce   *sync.Once
 }
 
 //ClientError represents an error that occurs within a cient
@@ -35,57 +34,72 @@ type ClientError struct {
 	Fatal  bool
 }
 
-//NewFirebaseClient creates a FirebaseClient from the given XMPPConfig
-func NewFirebaseClient(clientID string, recvChannel chan<- UpstreamMessage, sendChannel <-chan DownstreamPayload, signalChannel chan<- Signal, errorChannel chan<- ClientError) (FirebaseClient, error) {
-	appConfig, err := config.GetConfig()
-	if err != nil {
-		return FirebaseClient{}, err
-	}
+//DeliveryStatus represents how far a downstream message has gotten in being delivered
+type DeliveryStatus int
 
-	xmppConfig := appConfig.XMPP
-	//TODO: Detect if debug. For now, use dev port and set debug to true. For now, we will just always do this.
-	server := fmt.Sprintf("%s:%d", fcmServer, fcmDevPort)
-	username := fmt.Sprintf("%s@%s", xmppConfig.SenderID, fcmUsernameAddres)
-	client, err := xmpp.NewClient(server, username, xmppConfig.ServerKey, true)
-	if err != nil {
-		return FirebaseClient{}, err
-	}
+const (
+	//SentStatus indicates that a payload was written to FCM
+	SentStatus DeliveryStatus = iota
+	//SendFailedStatus indicates that a payload could not be written to FCM
+	SendFailedStatus
+	//ACKStatus indicates that FCM accepted a payload
+	ACKStatus
+	//RetryingStatus indicates that FCM rejected a payload, but it will be sent again
+	RetryingStatus
+	//NACKStatus indicates that FCM rejected a payload, and it will not be sent again
+	NACKStatus
+	//DeliveredStatus indicates that FCM delivered a payload to the device
+	DeliveredStatus
+)
+
+//DeliveryUpdate represents a change in the status of a downstream message, identified by the message_id of its payload.
+//For NACKStatus and RetryingStatus, ErrorCode and ErrorDescription hold what FCM gave as the reason, and RegistrationID holds the registration id the payload was sent to. For SendFailedStatus, Err holds the error that occurred.
+type DeliveryUpdate struct {
+	Client           *FirebaseClient
+	MessageID        string
+	Status           DeliveryStatus
+	RegistrationID   string
+	ErrorCode        string
+	ErrorDescription string
+	Err              error
+}
 
+//NewFirebaseClient creates a FirebaseClient that communicates with FCM over the given transport
+//Payloads that are NACKed with a retryable error are re-sent by retryScheduler. Upstream messages already in upstreamCache are not passed on to recvChannel.
+func NewFirebaseClient(clientID string, transport Transport, recvChannel chan<- UpstreamMessage, sendChannel <-chan DownstreamPayload, deliveryChannel chan<- DeliveryUpdate, retryScheduler *RetryScheduler, upstreamCache *UpstreamCache, signalChannel chan<- Signal, errorChannel chan<- ClientError) FirebaseClient {
 	return FirebaseClient{
-		xmppClient:    *client,
-		ClientID:      clientID,
-		senderID:      xmppConfig.SenderID,
-		serverKey:     xmppConfig.ServerKey,
-		recvChannel:   recvChannel,
-		sendChannel:   sendChannel,
-		signalChannel: signalChannel,
-		errorChannel:  errorChannel,
-	}, nil
+		ClientID:        clientID,
+		transport:       transport,
+		recvChannel:     recvChannel,
+		sendChannel:     sendChannel,
+		deliveryChannel: deliveryChannel,
+		retryScheduler:  retryScheduler,
+		upstreamCache:   upstreamCache,
+		inFlight:        newInFlightWindow(maxInFlightMessages),
+		signalChannel:   signalChannel,
+		errorChannel:    errorChannel,
+		stopSending:     make(chan struct{}),
+		stopOnce:        &sync.Once{},
+		closeOnce:       &sync.Once{},
+	}
 }
 
 //StartRecv listens for incoming  messages from Firebase Cloud Messaging and acts on them as defined by their type of message.
+//Terminates when the connection fails, at which point the client is closed and a ConnectionClosedSignal is sent.
 func (client *FirebaseClient) StartRecv() {
 	for {
-		data, err := client.xmppClient.Recv()
+		messageBody, err := client.transport.Recv()
 		if err != nil {
-			//encoding/xml adds a bunch of extra stuff to XML errors, including the line number. However, all we care about is whether or not an EOF was reached.
-			if strings.Contains(err.Error(), io.EOF.Error()) {
-				closeSignal := NewConnectionClosedSignal(client)
-				client.signalChannel <- closeSignal
-				break
-			} else {
+			//Once Recv has failed, it will never succeed again, so the connection must be replaced.
+			if err != io.EOF {
 				client.logError(err, false)
 			}
+			client.Close()
+			closeSignal := NewConnectionClosedSignal(client)
+			client.signalChannel <- closeSignal
+			return
 		}
 
-		chat, ok := data.(xmpp.Chat)
-		if !ok {
-			//xmpp.Recv can return a xmpp.Chat or a xmpp.Presence. We don't care about presence notifications.
-			//Though the FCM spec makes no mention of them, because it doesn't explicitly say we will never recieve them, we must handle them somehow - in this case, ignoring them.
-			continue
-		}
-
-		messageBody := []byte(chat.Other[0])
 		message, err := parseFCMMessage(messageBody)
 		if err != nil {
 			client.logError(err, false)
@@ -98,29 +112,135 @@ func (client *FirebaseClient) StartRecv() {
 	}
 }
 
-//ListenForSend listens for a message on sendChannel and sends the message.
-//Terminates when sendChannel is closed
+//ListenForSend listens for a message on sendChannel and sends the message. The outcome of every send is reported on deliveryChannel.
+//No more than maxInFlightMessages will be sent without FCM responding to them. Until FCM does, no more messages are taken from sendChannel, leaving them for other clients.
+//Terminates when sendChannel is closed, or StopSending is called
 func (client *FirebaseClient) ListenForSend() {
-	for payload := range client.sendChannel {
+	for {
+		client.inFlight.waitForCapacity()
+		var payload DownstreamPayload
+		var ok bool
+		select {
+		case payload, ok = <-client.sendChannel:
+			if !ok {
+				return
+			}
+		case <-client.stopSending:
+			return
+		}
+
+		//The payload may have been routed to us just as we were stopped
+		select {
+		case <-client.stopSending:
+			client.retryScheduler.Track(payload)
+			client.abandon(payload)
+			return
+		default:
+		}
+
+		client.inFlight.add(payload)
+		client.retryScheduler.Track(payload)
 		err := client.sendPayload(payload)
 		if err != nil {
+			client.inFlight.release(payload.MessageID)
+			client.retryScheduler.Forget(payload.MessageID)
 			client.logError(err, false)
+			client.reportDelivery(DeliveryUpdate{
+				MessageID: payload.MessageID,
+				Status:    SendFailedStatus,
+				Err:       err,
+			})
+		} else {
+			client.reportDelivery(DeliveryUpdate{
+				MessageID: payload.MessageID,
+				Status:    SentStatus,
+			})
 		}
 	}
 }
 
 //sendPayload sends a payload downstream to FCM
 func (client *FirebaseClient) sendPayload(payload DownstreamPayload) error {
-	downstreamMessage, err := constructDownstreamMessage(payload)
+	marshaledPayload, err := json.Marshal(payload)
 	if err != nil {
 		return err
 	}
 
-	_, err = client.xmppClient.SendOrg(string(downstreamMessage))
+	return client.transport.Send(marshaledPayload)
+}
+
+//StopSending stops the client from taking any more payloads from sendChannel. Payloads already sent may still be ACKed or NACKed.
+func (client *FirebaseClient) StopSending() {
+	client.stopOnce.Do(func() {
+		close(client.stopSending)
+	})
+}
+
+//Close closes the client's connection to FCM and stops it from sending. Payloads that FCM has not yet responded to are retried, as it never will.
+//Closing a client that is already closed does nothing.
+func (client *FirebaseClient) Close() error {
+	var err error
+	client.closeOnce.Do(func() {
+		client.StopSending()
+		err = client.transport.Close()
+		for _, payload := range client.inFlight.releaseAll() {
+			client.abandon(payload)
+		}
+	})
 
 	return err
 }
 
+//WaitForInFlight blocks until FCM has responded to every payload this client has sent, or the timeout passes. Returns false if the timeout passed first.
+//This should only be used after StopSending, or more payloads may be sent while waiting.
+func (client *FirebaseClient) WaitForInFlight(timeout time.Duration) bool {
+	return client.inFlight.waitForEmpty(timeout)
+}
+
+//TakeInFlight removes every payload that FCM has not yet responded to from the client, so that they can be sent by another client.
+//The payloads are still tracked by the RetryScheduler. Responses from FCM that arrive for them on this client are ignored.
+func (client *FirebaseClient) TakeInFlight() []DownstreamPayload {
+	return client.inFlight.releaseAll()
+}
+
+//abandon gives up on sending a payload over this client, scheduling it to be retried if it has attempts remaining.
+func (client *FirebaseClient) abandon(payload DownstreamPayload) {
+	nack := NACKMessage{
+		From:             payload.To,
+		MessageID:        payload.MessageID,
+		Error:            ConnectionClosedError,
+		ErrorDescription: "connection closed before FCM responded",
+	}
+	update := DeliveryUpdate{
+		MessageID:        nack.MessageID,
+		Status:           NACKStatus,
+		RegistrationID:   nack.From,
+		ErrorCode:        nack.Error,
+		ErrorDescription: nack.ErrorDescription,
+	}
+	if client.retryScheduler.HandleNACK(nack) {
+		update.Status = RetryingStatus
+	}
+
+	client.reportDelivery(update)
+}
+
+//InFlightCount gets the number of messages this client has sent that FCM has not yet ACKed or NACKed
+func (client *FirebaseClient) InFlightCount() int {
+	return client.inFlight.count()
+}
+
+//HasCapacity returns whether or not this client may send another message without exceeding FCM's limit on un-ACKed messages
+func (client *FirebaseClient) HasCapacity() bool {
+	return client.InFlightCount() < maxInFlightMessages
+}
+
+//reportDelivery sends a DeliveryUpdate about a message sent by this client upstream to the delivery channel
+func (client *FirebaseClient) reportDelivery(update DeliveryUpdate) {
+	update.Client = client
+	client.deliveryChannel <- update
+}
+
 //logError sends an error upstream to the error channel
 func (client *FirebaseClient) logError(err error, fatal bool) {
 	clientError := ClientError{
@@ -131,13 +251,11 @@ func (client *FirebaseClient) logError(err error, fatal bool) {
 	client.errorChannel <- clientError
 }
 
-func (client *FirebaseClient) sendACK(message UpstreamMessage) error {
-	ack, err := ConstructACK(message.From, message.MessageID)
+func (client *FirebaseClient) sendACK(from string, messageID string) error {
+	ack, err := json.Marshal(NewACKPayload(from, messageID))
 	if err != nil {
 		return err
 	}
 
-	_, err = client.xmppClient.SendOrg(string(ack))
-
-	return err
+	return client.transport.Send(ack)
 }
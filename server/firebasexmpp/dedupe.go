@@ -0,0 +1,69 @@
+package firebasexmpp
+
+import (
+	"sync"
+)
+
+//DefaultUpstreamCacheSize is the number of upstream messages an UpstreamCache made by the supervisor remembers.
+//FCM redelivers un-ACKed messages fairly quickly, so this only needs to cover the messages received over a few reconnects.
+const DefaultUpstreamCacheSize = 10000
+
+//upstreamMessageKey identifies an upstream message. FCM message ids are chosen by the device, so they are only unique per sender.
+type upstreamMessageKey struct {
+	from      string
+	messageID string
+}
+
+func makeUpstreamMessageKey(message UpstreamMessage) upstreamMessageKey {
+	return upstreamMessageKey{from: message.From, messageID: message.MessageID}
+}
+
+//UpstreamCache remembers the most recently ACKed upstream messages, so that messages FCM redelivers (such as when our ACK is lost) are not passed on twice.
+//It is bounded; once full, the oldest message is forgotten for every new one. Anything that gets past it must still be deduplicated by whoever stores the message.
+type UpstreamCache struct {
+	seen map[upstreamMessageKey]struct{}
+	//order is a ring of the keys in seen, oldest first starting at next
+	order []upstreamMessageKey
+	next  int
+	mux   sync.Mutex
+}
+
+//NewUpstreamCache makes an UpstreamCache that remembers up to size messages
+func NewUpstreamCache(size int) *UpstreamCache {
+	return &UpstreamCache{
+		seen:  make(map[upstreamMessageKey]struct{}, size),
+		order: make([]upstreamMessageKey, 0, size),
+	}
+}
+
+//Contains returns whether or not the given message has been added to the cache
+func (cache *UpstreamCache) Contains(message UpstreamMessage) bool {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+
+	_, ok := cache.seen[makeUpstreamMessageKey(message)]
+
+	return ok
+}
+
+//Add records that the given message has been processed. Returns false if the message had already been added.
+func (cache *UpstreamCache) Add(message UpstreamMessage) bool {
+	key := makeUpstreamMessageKey(message)
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+
+	if _, ok := cache.seen[key]; ok {
+		return false
+	}
+
+	if len(cache.order) < cap(cache.order) {
+		cache.order = append(cache.order, key)
+	} else {
+		delete(cache.seen, cache.order[cache.next])
+		cache.order[cache.next] = key
+		cache.next = (cache.next + 1) % len(cache.order)
+	}
+	cache.seen[key] = struct{}{}
+
+	return true
+}
@@ -0,0 +1,109 @@
+package firebasexmpp
+
+import (
+	"sync"
+	"time"
+)
+
+//maxInFlightMessages is the maximum number of downstream messages FCM allows to be un-ACKed on a single connection.
+//See https://firebase.google.com/docs/cloud-messaging/server#flow-control
+const maxInFlightMessages = 100
+
+//inFlightWindow tracks the payloads that a client has sent but that FCM has not yet ACKed or NACKed, and limits how many there may be.
+type inFlightWindow struct {
+	payloads map[string]DownstreamPayload
+	size     int
+	mux      sync.Mutex
+	//released is signalled whenever a payload leaves the window
+	released *sync.Cond
+}
+
+func newInFlightWindow(size int) *inFlightWindow {
+	window := &inFlightWindow{
+		payloads: make(map[string]DownstreamPayload),
+		size:     size,
+	}
+	window.released = sync.NewCond(&window.mux)
+
+	return window
+}
+
+//waitForCapacity blocks until there is room in the window for at least one more payload
+func (window *inFlightWindow) waitForCapacity() {
+	window.mux.Lock()
+	defer window.mux.Unlock()
+
+	for len(window.payloads) >= window.size {
+		window.released.Wait()
+	}
+}
+
+//add puts a payload in the window. Callers should call waitForCapacity first; add does not enforce the window size itself.
+func (window *inFlightWindow) add(payload DownstreamPayload) {
+	window.mux.Lock()
+	defer window.mux.Unlock()
+
+	window.payloads[payload.MessageID] = payload
+}
+
+//release removes a payload from the window, given its message id. Returns false if the payload was not in the window.
+func (window *inFlightWindow) release(messageID string) bool {
+	window.mux.Lock()
+	defer window.mux.Unlock()
+
+	if _, ok := window.payloads[messageID]; !ok {
+		return false
+	}
+
+	delete(window.payloads, messageID)
+	window.released.Broadcast()
+
+	return true
+}
+
+//waitForEmpty blocks until every payload has left the window, or the timeout passes. Returns false if the timeout passed first.
+func (window *inFlightWindow) waitForEmpty(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	//sync.Cond can't time out by itself, so wake up the waiter when the deadline passes.
+	timer := time.AfterFunc(timeout, func() {
+		window.mux.Lock()
+		window.released.Broadcast()
+		window.mux.Unlock()
+	})
+	defer timer.Stop()
+
+	window.mux.Lock()
+	defer window.mux.Unlock()
+
+	for len(window.payloads) > 0 {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		window.released.Wait()
+	}
+
+	return true
+}
+
+//releaseAll empties the window, returning every payload that was in it
+func (window *inFlightWindow) releaseAll() []DownstreamPayload {
+	window.mux.Lock()
+	defer window.mux.Unlock()
+
+	payloads := make([]DownstreamPayload, 0, len(window.payloads))
+	for _, payload := range window.payloads {
+		payloads = append(payloads, payload)
+	}
+	window.payloads = make(map[string]DownstreamPayload)
+	window.released.Broadcast()
+
+	return payloads
+}
+
+//count gets the number of payloads in the window
+func (window *inFlightWindow) count() int {
+	window.mux.Lock()
+	defer window.mux.Unlock()
+
+	return len(window.payloads)
+}
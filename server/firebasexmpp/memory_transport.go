@@ -0,0 +1,78 @@
+package firebasexmpp
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+//ErrTransportClosed is returned when sending on a Transport that has been closed
+var ErrTransportClosed = errors.New("firebasexmpp: transport closed")
+
+//MemoryTransport is a Transport that never leaves the process. Messages given to Deliver are received by the client, and messages the client sends are available on Sent.
+//It is intended for testing code that uses a FirebaseClient without connecting to FCM.
+type MemoryTransport struct {
+	incoming  chan []byte
+	outgoing  chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+//NewMemoryTransport makes a new, open, MemoryTransport
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{
+		incoming: make(chan []byte),
+		outgoing: make(chan []byte),
+		closed:   make(chan struct{}),
+	}
+}
+
+//Recv blocks until a message is delivered with Deliver, or the transport is closed
+func (transport *MemoryTransport) Recv() ([]byte, error) {
+	select {
+	case message := <-transport.incoming:
+		return message, nil
+	case <-transport.closed:
+		return nil, io.EOF
+	}
+}
+
+//Send blocks until the message is read from Sent, or the transport is closed
+func (transport *MemoryTransport) Send(message []byte) error {
+	select {
+	case transport.outgoing <- message:
+		return nil
+	case <-transport.closed:
+		return ErrTransportClosed
+	}
+}
+
+//Close closes the transport. Closing an already closed transport does nothing.
+func (transport *MemoryTransport) Close() error {
+	transport.closeOnce.Do(func() {
+		close(transport.closed)
+	})
+
+	return nil
+}
+
+//Deliver acts as FCM sending a message to the client, and blocks until the client has received it.
+//Returns ErrTransportClosed if the transport is closed first.
+func (transport *MemoryTransport) Deliver(message []byte) error {
+	select {
+	case transport.incoming <- message:
+		return nil
+	case <-transport.closed:
+		return ErrTransportClosed
+	}
+}
+
+//Sent gets the channel that messages sent by the client are received on. It must be read from, or the client's sends will block.
+func (transport *MemoryTransport) Sent() <-chan []byte {
+	return transport.outgoing
+}
+
+//Closed gets a channel that is closed once the transport is closed
+func (transport *MemoryTransport) Closed() <-chan struct{} {
+	return transport.closed
+}
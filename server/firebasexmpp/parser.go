@@ -19,6 +19,8 @@ type UpstreamMessage struct {
 	MessageID string `json:"message_id"`
 	Category  string `json:"category"`
 	Data      json.RawMessage
+	//client is the client the message was received on, which must be used to ACK it
+	client *FirebaseClient
 }
 
 //InboundACKMessage stores the basic data from an ACK message that Firebase CLoud Messaging when we send a message downstream.
@@ -35,6 +37,17 @@ type NACKMessage struct {
 	ErrorDescription string `json:"error_description"`
 }
 
+//ReceiptMessage stores the basic data from a delivery receipt, which Firebase Cloud Messaging sends when a message with delivery_receipt_requested set reaches the device.
+type ReceiptMessage struct {
+	From      string `json:"from"`
+	MessageID string `json:"message_id"`
+	Data      struct {
+		MessageStatus        string `json:"message_status"`
+		OriginalMessageID    string `json:"original_message_id"`
+		DeviceRegistrationID string `json:"device_registration_id"`
+	} `json:"data"`
+}
+
 //ConnectionDrainingMessage indicates a CONNECTION_DRAINING message.
 type ConnectionDrainingMessage struct{}
 
@@ -58,6 +71,8 @@ func parseFCMMessage(data []byte) (FCMMessage, error) {
 		parsedMessage = &InboundACKMessage{}
 	case "nack":
 		parsedMessage = &NACKMessage{}
+	case "receipt":
+		parsedMessage = &ReceiptMessage{}
 	case "control":
 		//Per the spec, CONNECTION_DRAINING is the only control_type supported. We can save CPU time by not checking the control_type.
 		parsedMessage = &ConnectionDrainingMessage{}
@@ -72,31 +87,98 @@ func parseFCMMessage(data []byte) (FCMMessage, error) {
 	return parsedMessage, nil
 }
 
-//PerformAction sends the SMS message upstream to the main program
+//PerformAction sends the SMS message upstream to the main program, unless it has been received before.
+//The message is not ACKed here; whoever receives it must call ACK once it has been processed, or FCM will deliver it again.
 func (message UpstreamMessage) PerformAction(client *FirebaseClient) error {
-	err := client.sendACK(message)
+	//FCM is redelivering this message because it never got our ACK, so it must be ACKed again.
+	if client.upstreamCache.Contains(message) {
+		return client.sendACK(message.From, message.MessageID)
+	}
+
+	message.client = client
+	client.recvChannel <- message
+
+	return nil
+}
+
+//ACK acknowledges the message to FCM, so that it will not be delivered again. This should only be called once the message has been durably processed.
+//If the connection the message was received on has since closed, an error is returned; FCM will deliver the message again on another connection.
+func (message UpstreamMessage) ACK() error {
+	if message.client == nil {
+		return errors.New("firebasexmpp: message was not received from a client")
+	}
+
+	err := message.client.sendACK(message.From, message.MessageID)
 	if err != nil {
 		return err
 	}
 
-	client.recvChannel <- message
+	message.client.upstreamCache.Add(message)
 
 	return nil
 }
 
-//PerformAction is a stub to satisfy the FCMMessage interface.
-//Presently, there is no mechanism in place to wait for an ACK, so we're just stubbing this.
+//PerformAction informs the delivery channel that FCM has accepted the message.
 func (message InboundACKMessage) PerformAction(client *FirebaseClient) error {
+	//A payload that isn't in flight on this client has been handed to another client, which will report on it instead.
+	if !client.inFlight.release(message.MessageID) {
+		return nil
+	}
+
+	client.retryScheduler.Forget(message.MessageID)
+	client.reportDelivery(DeliveryUpdate{
+		MessageID: message.MessageID,
+		Status:    ACKStatus,
+	})
+
 	return nil
 }
 
-//PerformAction will return a properly formatted error object for the error given by FCM.
+//PerformAction schedules the message to be sent again if FCM's error allows it, and informs the delivery channel of the outcome.
+//If the message will not be retried, a properly formatted error object for the error given by FCM is returned.
 func (message NACKMessage) PerformAction(client *FirebaseClient) error {
+	//Whether or not the message is retried, FCM is done with it on this connection.
+	if !client.inFlight.release(message.MessageID) {
+		//The payload has been handed to another client, which will report on it instead.
+		return nil
+	}
+
+	update := DeliveryUpdate{
+		MessageID:        message.MessageID,
+		Status:           NACKStatus,
+		RegistrationID:   message.From,
+		ErrorCode:        message.Error,
+		ErrorDescription: message.ErrorDescription,
+	}
+	if client.retryScheduler.HandleNACK(message) {
+		update.Status = RetryingStatus
+		client.reportDelivery(update)
+		return nil
+	}
+
+	client.reportDelivery(update)
+
 	return fmt.Errorf("firebasexmpp: %s - %s", message.Error, message.ErrorDescription)
 }
 
-//PerformAction informs the signal channel that this connection needs to be drained.
+//PerformAction acknowledges the receipt, as FCM requires for all receipts, and informs the delivery channel that the original message was delivered.
+func (message ReceiptMessage) PerformAction(client *FirebaseClient) error {
+	err := client.sendACK(message.From, message.MessageID)
+	if err != nil {
+		return err
+	}
+
+	client.reportDelivery(DeliveryUpdate{
+		MessageID: message.Data.OriginalMessageID,
+		Status:    DeliveredStatus,
+	})
+
+	return nil
+}
+
+//PerformAction stops the client from sending, as FCM will no longer accept messages on this connection, and informs the signal channel that it needs to be drained.
 func (message ConnectionDrainingMessage) PerformAction(client *FirebaseClient) error {
+	client.StopSending()
 	drainSignal := NewConnectionDrainingSignal(client)
 	client.signalChannel <- drainSignal
 	return nil
@@ -0,0 +1,126 @@
+package firebasexmpp
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+//Error codes that FCM may give in a NACK. See https://firebase.google.com/docs/cloud-messaging/xmpp-server-ref#table4
+const (
+	InvalidJSONError               = "INVALID_JSON"
+	BadRegistrationError           = "BAD_REGISTRATION"
+	DeviceUnregisteredError        = "DEVICE_UNREGISTERED"
+	BadACKError                    = "BAD_ACK"
+	ServiceUnavailableError        = "SERVICE_UNAVAILABLE"
+	InternalServerError            = "INTERNAL_SERVER_ERROR"
+	DeviceMessageRateExceededError = "DEVICE_MESSAGE_RATE_EXCEEDED"
+	TopicsMessageRateExceededError = "TOPICS_MESSAGE_RATE_EXCEEDED"
+	ConnectionDrainingError        = "CONNECTION_DRAINING"
+	//ConnectionClosedError is not given by FCM. It is used for payloads that FCM never responded to because their connection closed.
+	ConnectionClosedError = "CONNECTION_CLOSED"
+)
+
+const (
+	//maxSendAttempts is the number of times a payload will be sent before a retryable NACK is treated as permanent
+	maxSendAttempts       = 6
+	defaultRetryBaseDelay = time.Second
+	//Rate limits last longer than outages, so there is no point in retrying them as quickly.
+	rateExceededRetryBaseDelay = 10 * time.Second
+	maxRetryDelay              = 10 * time.Minute
+)
+
+//RetryScheduler keeps every downstream payload until FCM has responded to it, so that payloads that are NACKed with a retryable error can be sent again.
+//Retries are sent with exponential backoff, with full jitter, so that many NACKs at once don't produce a burst of retries.
+type RetryScheduler struct {
+	sendChannel chan<- DownstreamPayload
+	pending     map[string]pendingPayload
+	pendingMux  sync.Mutex
+}
+
+//pendingPayload holds a payload that has been sent, but not yet ACKed or NACKed
+type pendingPayload struct {
+	payload  DownstreamPayload
+	attempts int
+}
+
+//NewRetryScheduler makes a new RetryScheduler that re-sends payloads on the given sendChannel
+func NewRetryScheduler(sendChannel chan<- DownstreamPayload) *RetryScheduler {
+	return &RetryScheduler{
+		sendChannel: sendChannel,
+		pending:     make(map[string]pendingPayload),
+	}
+}
+
+//IsRetryableNACK returns whether or not a NACK with the given error code may succeed if sent again
+func IsRetryableNACK(errorCode string) bool {
+	switch errorCode {
+	case ServiceUnavailableError, InternalServerError, DeviceMessageRateExceededError, TopicsMessageRateExceededError, ConnectionDrainingError, ConnectionClosedError:
+		return true
+	default:
+		return false
+	}
+}
+
+//IsRegistrationInvalidNACK returns whether or not a NACK with the given error code means the registration id it was sent to should never be used again
+func IsRegistrationInvalidNACK(errorCode string) bool {
+	return errorCode == BadRegistrationError || errorCode == DeviceUnregisteredError
+}
+
+//Track records that a payload is being sent, so that it can be retried if need be.
+func (scheduler *RetryScheduler) Track(payload DownstreamPayload) {
+	scheduler.pendingMux.Lock()
+	defer scheduler.pendingMux.Unlock()
+
+	pending := scheduler.pending[payload.MessageID]
+	pending.payload = payload
+	pending.attempts++
+	scheduler.pending[payload.MessageID] = pending
+}
+
+//Forget stops tracking a payload. Used when FCM has accepted it, or it will not be retried.
+func (scheduler *RetryScheduler) Forget(messageID string) {
+	scheduler.pendingMux.Lock()
+	defer scheduler.pendingMux.Unlock()
+
+	delete(scheduler.pending, messageID)
+}
+
+//HandleNACK schedules a retry for the NACKed payload if its error is retryable and it has attempts remaining.
+//Returns true if a retry was scheduled. If not, the payload is no longer tracked.
+func (scheduler *RetryScheduler) HandleNACK(message NACKMessage) bool {
+	scheduler.pendingMux.Lock()
+	defer scheduler.pendingMux.Unlock()
+
+	pending, ok := scheduler.pending[message.MessageID]
+	if !ok || !IsRetryableNACK(message.Error) || pending.attempts >= maxSendAttempts {
+		delete(scheduler.pending, message.MessageID)
+		return false
+	}
+
+	delay := getRetryDelay(message.Error, pending.attempts)
+	time.AfterFunc(delay, func() {
+		scheduler.sendChannel <- pending.payload
+	})
+
+	return true
+}
+
+//getRetryDelay gets a random delay between zero and the exponential backoff for the given attempt
+func getRetryDelay(errorCode string, attempts int) time.Duration {
+	baseDelay := defaultRetryBaseDelay
+	if errorCode == DeviceMessageRateExceededError || errorCode == TopicsMessageRateExceededError {
+		baseDelay = rateExceededRetryBaseDelay
+	}
+
+	backoff := maxRetryDelay
+	//Past this many attempts, the backoff would overflow or exceed the max regardless
+	if attempts < 20 {
+		backoff = baseDelay * time.Duration(1<<uint(attempts-1))
+	}
+	if backoff > maxRetryDelay {
+		backoff = maxRetryDelay
+	}
+
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
@@ -0,0 +1,169 @@
+package firebasexmpp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/mattn/go-xmpp"
+	"github.com/ollien/sms-pusher/server/config"
+)
+
+const fcmServer = "fcm-xmpp.googleapis.com"
+const fcmDevPort = 5236
+const fcmProdPort = 5235
+const fcmUsernameAddres = "gcm.googleapis.com"
+
+//Transport is a connection to FCM that a FirebaseClient sends and receives its messages over.
+//Messages are the JSON bodies of FCM's XMPP stanzas; the transport is responsible for any framing around them.
+type Transport interface {
+	//Recv blocks until FCM sends a message. io.EOF is returned once the connection has been closed.
+	Recv() ([]byte, error)
+	//Send sends a message to FCM. It must be safe to call Send while another Send or a Recv is in progress.
+	Send(message []byte) error
+	//Close closes the connection. Any blocked Recv returns io.EOF.
+	Close() error
+}
+
+//Dialer opens a new Transport to FCM
+type Dialer func() (Transport, error)
+
+//xmppTransport is a Transport over a real XMPP connection
+type xmppTransport struct {
+	client *xmpp.Client
+	//sendMux guards writes to client, as upstream messages may be ACKed from outside of the FirebaseClient
+	sendMux sync.Mutex
+}
+
+//DialXMPP opens an XMPP connection to FCM, as configured in the XMPPConfig
+func DialXMPP() (Transport, error) {
+	appConfig, err := config.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewXMPPTransport(appConfig.XMPP)
+}
+
+//NewXMPPTransport opens an XMPP connection to FCM with the given XMPPConfig
+func NewXMPPTransport(xmppConfig config.XMPPConfig) (Transport, error) {
+	options, err := makeXMPPOptions(xmppConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := options.NewClient()
+	if err != nil {
+		return nil, err
+	}
+
+	return &xmppTransport{client: client}, nil
+}
+
+//Recv receives the next message from FCM
+func (transport *xmppTransport) Recv() ([]byte, error) {
+	for {
+		data, err := transport.client.Recv()
+		if err != nil {
+			//encoding/xml adds a bunch of extra stuff to XML errors, including the line number. However, all we care about is whether or not an EOF was reached.
+			if strings.Contains(err.Error(), io.EOF.Error()) {
+				return nil, io.EOF
+			}
+
+			return nil, err
+		}
+
+		chat, ok := data.(xmpp.Chat)
+		if !ok || len(chat.Other) == 0 {
+			//xmpp.Recv can return a xmpp.Chat or a xmpp.Presence. We don't care about presence notifications.
+			//Though the FCM spec makes no mention of them, because it doesn't explicitly say we will never recieve them, we must handle them somehow - in this case, ignoring them.
+			continue
+		}
+
+		return []byte(chat.Other[0]), nil
+	}
+}
+
+//Send wraps a message in the stanzas FCM expects, and sends it
+func (transport *xmppTransport) Send(message []byte) error {
+	stanza, err := wrapInStanzas(message)
+	if err != nil {
+		return err
+	}
+
+	transport.sendMux.Lock()
+	defer transport.sendMux.Unlock()
+
+	_, err = transport.client.SendOrg(string(stanza))
+
+	return err
+}
+
+//Close closes the XMPP connection
+func (transport *xmppTransport) Close() error {
+	return transport.client.Close()
+}
+
+//makeXMPPOptions makes the options to connect to FCM with from the given XMPPConfig
+func makeXMPPOptions(xmppConfig config.XMPPConfig) (xmpp.Options, error) {
+	production, err := xmppConfig.IsProduction()
+	if err != nil {
+		return xmpp.Options{}, err
+	}
+
+	host := xmppConfig.Host
+	if host == "" {
+		host = fcmServer
+	}
+
+	port := xmppConfig.Port
+	if port == 0 && production {
+		port = fcmProdPort
+	} else if port == 0 {
+		port = fcmDevPort
+	}
+
+	tlsConfig, err := makeTLSConfig(xmppConfig.TLS)
+	if err != nil {
+		return xmpp.Options{}, err
+	}
+	//go-xmpp only fills in the server name when it makes the TLS config itself
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+
+	return xmpp.Options{
+		Host:      fmt.Sprintf("%s:%d", host, port),
+		User:      fmt.Sprintf("%s@%s", xmppConfig.SenderID, fcmUsernameAddres),
+		Password:  xmppConfig.ServerKey,
+		TLSConfig: tlsConfig,
+		Debug:     xmppConfig.Debug,
+	}, nil
+}
+
+//makeTLSConfig makes the TLS config to connect to FCM with from the given XMPPTLSConfig
+func makeTLSConfig(tlsSettings config.XMPPTLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         tlsSettings.ServerName,
+		InsecureSkipVerify: tlsSettings.InsecureSkipVerify,
+	}
+
+	if tlsSettings.CAFile != "" {
+		caCert, err := ioutil.ReadFile(tlsSettings.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		certPool := x509.NewCertPool()
+		if !certPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("firebasexmpp: no certificates found in %s", tlsSettings.CAFile)
+		}
+		tlsConfig.RootCAs = certPool
+	}
+
+	return tlsConfig, nil
+}
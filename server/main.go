@@ -2,26 +2,69 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/ollien/sms-pusher/server/config"
 	"github.com/ollien/sms-pusher/server/db"
+	"github.com/ollien/sms-pusher/server/events"
 	"github.com/ollien/sms-pusher/server/firebasexmpp"
 	"github.com/ollien/sms-pusher/server/messaging"
+	"github.com/ollien/sms-pusher/server/phonenumber"
+	"github.com/ollien/sms-pusher/server/threads"
+	uuid "github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
 func main() {
+	config, err := config.GetConfig()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
 	server, err := NewServer()
 	if err != nil {
 		logrus.Fatal(err)
 	}
 
-	defer server.Stop()
-	server.Run()
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, syscall.SIGTERM, syscall.SIGINT)
+	runErrorChannel := make(chan error, 1)
+	go func() {
+		runErrorChannel <- server.Run()
+	}()
+
+	exitCode := 0
+	select {
+	case receivedSignal := <-signalChannel:
+		server.logger.Infof("Received %s, shutting down", receivedSignal)
+	case err = <-runErrorChannel:
+		server.logger.Errorf("Server stopped unexpectedly, shutting down: %s", err)
+		exitCode = 1
+	}
+
+	//Give an impatient operator a way out if shutting down is taking too long
+	go func() {
+		receivedSignal := <-signalChannel
+		server.logger.Warnf("Received %s again, exiting immediately", receivedSignal)
+		os.Exit(1)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.Shutdown.GetDeadline())
+	err = server.Shutdown(ctx)
+	cancel()
+	if err != nil {
+		exitCode = 1
+	}
+
+	server.logger.Info("Shut down")
+	os.Exit(exitCode)
 }
 
 //setup sets up datbase rows such that the server can function.
@@ -73,19 +116,102 @@ func setup(databaseConnection db.DatabaseConnection) (bool, error) {
 	return false, nil
 }
 
-func listenForSMS(outChannel <-chan firebasexmpp.UpstreamMessage, logger *logrus.Logger) {
+//listenForSMS listens for messages sent upstream, stores them in the database against the device that sent them, and notifies the device's user of them.
+//Messages are only ACKed once they have been stored, or once it is clear they never can be. If a message cannot be stored for now, it is left un-ACKed so that FCM will deliver it again.
+func listenForSMS(outChannel <-chan firebasexmpp.UpstreamMessage, databaseConnection db.DatabaseConnection, normalizer phonenumber.Normalizer, eventHub *events.Hub, logger *logrus.Logger) {
 	for message := range outChannel {
-		//TODO: Find some way to ping the client of this event. Maybe websockets?
-		textMessage, err := messaging.ExtractTextMessage(message)
+		err := processSMS(message, databaseConnection, normalizer, eventHub, logger)
 		if err != nil {
-			logger.Error(err)
-			return
+			logger.WithField("message_id", message.MessageID).Errorf("Could not process message, leaving it for FCM to redeliver: %s", err)
+			continue
 		}
-		switch convertedMessage := textMessage.(type) {
-		case messaging.SMSMessage:
-			fmt.Printf("MESSAGE DETAILS\nFrom: %s\nAt: %d\nBody:%s\n\n", convertedMessage.PhoneNumber, convertedMessage.Timestamp, convertedMessage.Message)
-		case messaging.MMSMessage:
-			fmt.Printf("MESSAGE DETAILS\nFrom: %s\nTo:%v\nAt: %d\nBody:%s\nPartsBlockID:%s\n\n", convertedMessage.PhoneNumber, convertedMessage.Recipients, convertedMessage.Timestamp, convertedMessage.Message, convertedMessage.PartBlockID)
+
+		err = message.ACK()
+		if err != nil {
+			logger.WithField("message_id", message.MessageID).Errorf("Could not ACK message: %s", err)
 		}
 	}
 }
+
+//processSMS stores a single upstream message and notifies the user of the device that sent it.
+//An error is only returned if the message could be processed if it were received again; messages that are malformed, duplicated, from unknown devices, or otherwise can't be stored are logged and dropped.
+func processSMS(message firebasexmpp.UpstreamMessage, databaseConnection db.DatabaseConnection, normalizer phonenumber.Normalizer, eventHub *events.Hub, logger *logrus.Logger) error {
+	messageLogger := logger.WithField("message_id", message.MessageID)
+	textMessage, err := messaging.ExtractTextMessage(message)
+	if err != nil {
+		messageLogger.Errorf("Dropping malformed message: %s", err)
+		return nil
+	}
+
+	//Only messages from devices that have registered their FCM id with us are accepted. Anything else could have come from any app using our sender id.
+	device, err := databaseConnection.GetDeviceByFCMID([]byte(message.From))
+	if dbErr, ok := err.(*db.DatabaseError); ok && !dbErr.DatabaseFault {
+		messageLogger.Warn("Dropping message from unregistered FCM id")
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not find device for message: %s", err)
+	}
+
+	storableMessage, err := makeStorableMessage(message.MessageID, textMessage, normalizer)
+	if err != nil {
+		messageLogger.Errorf("Dropping malformed message: %s", err)
+		return nil
+	}
+
+	storedMessage, err := databaseConnection.RecordMessage(device, storableMessage, threads.Participants(storableMessage))
+	if err != nil && err.Error() == db.DuplicateMessageError {
+		messageLogger.Info("Dropping duplicate message")
+		return nil
+	} else if dbErr, ok := err.(*db.DatabaseError); ok && !dbErr.DatabaseFault {
+		//FCM would redeliver the message forever if it were never ACKed
+		messageLogger.Errorf("Dropping message that can't be stored: %s", err)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not store message: %s", err)
+	}
+
+	eventHub.Publish(events.NewIncomingMessageEvent(storedMessage))
+
+	return nil
+}
+
+//makeStorableMessage converts a TextMessage into a db.Message so that it may be stored in the database. All phone numbers are normalized with the given normalizer.
+func makeStorableMessage(fcmMessageID string, textMessage messaging.TextMessage, normalizer phonenumber.Normalizer) (db.Message, error) {
+	var storableMessage db.Message
+	switch convertedMessage := textMessage.(type) {
+	case messaging.SMSMessage:
+		phoneNumber := normalizer.Parse(convertedMessage.PhoneNumber)
+		storableMessage = db.Message{
+			PhoneNumber:    phoneNumber.Normalized,
+			RawPhoneNumber: phoneNumber.Raw,
+			Body:           convertedMessage.Message,
+			SentAt:         time.Unix(convertedMessage.Timestamp, 0),
+		}
+	case messaging.MMSMessage:
+		phoneNumber := normalizer.Parse(convertedMessage.PhoneNumber)
+		storableMessage = db.Message{
+			PhoneNumber:    phoneNumber.Normalized,
+			RawPhoneNumber: phoneNumber.Raw,
+			RawRecipients:  convertedMessage.Recipients,
+			Body:           convertedMessage.Message,
+			MMS:            true,
+			SentAt:         time.Unix(convertedMessage.Timestamp, 0),
+		}
+		for _, recipient := range normalizer.ParseAll(convertedMessage.Recipients) {
+			storableMessage.Recipients = append(storableMessage.Recipients, recipient.Normalized)
+		}
+		if convertedMessage.PartBlockID != "" {
+			blockID, err := uuid.FromString(convertedMessage.PartBlockID)
+			if err != nil {
+				return db.Message{}, err
+			}
+			storableMessage.BlockID = uuid.NullUUID{UUID: blockID, Valid: true}
+		}
+	default:
+		return db.Message{}, fmt.Errorf("unknown message type %T", textMessage)
+	}
+
+	storableMessage.FCMMessageID = fcmMessageID
+
+	return storableMessage, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ollien/sms-pusher/server/db"
+	"github.com/ollien/sms-pusher/server/events"
+	"github.com/ollien/sms-pusher/server/fcmtest"
+	"github.com/ollien/sms-pusher/server/firebasexmpp"
+	"github.com/ollien/sms-pusher/server/phonenumber"
+	uuid "github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	//testDatabaseEnv must be set for tests that need a database to run. They use the database in config.json, which must be safe to write test data to.
+	testDatabaseEnv = "SMS_PUSHER_TEST_DATABASE"
+	//testTimeout is how long to wait for anything to come from the fake FCM server
+	testTimeout = 5 * time.Second
+	//channelBufferSize is large enough that nothing in a test ever blocks on a full channel
+	channelBufferSize = 64
+)
+
+func newTestDatabase(t *testing.T, logger *logrus.Logger) db.DatabaseConnection {
+	t.Helper()
+	if os.Getenv(testDatabaseEnv) == "" {
+		t.Skipf("%s is not set", testDatabaseEnv)
+	}
+
+	databaseConnection, err := db.NewDatabaseConnection(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = databaseConnection.Connect()
+	if err != nil {
+		t.Fatalf("could not connect to database: %s", err)
+	}
+	t.Cleanup(func() {
+		databaseConnection.Close()
+	})
+
+	return databaseConnection
+}
+
+//newTestID makes an id that no other test uses, so that tests don't conflict with data left by earlier runs
+func newTestID(t *testing.T) string {
+	t.Helper()
+	id, err := uuid.NewV4()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return id.String()
+}
+
+//newTestDevice makes a new user with a single device, registered with the given FCM id
+func newTestDevice(t *testing.T, databaseConnection db.DatabaseConnection, fcmID string) db.Device {
+	t.Helper()
+	//usernames may only be 32 characters long
+	username := "test-" + newTestID(t)[:8]
+	err := databaseConnection.CreateUser(username, []byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := databaseConnection.GetUser(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	device, _, err := databaseConnection.RegisterDeviceToUser(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = databaseConnection.RegisterFCMID(device.ID, []byte(fcmID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return device
+}
+
+//startListeningForSMS connects a FirebaseClient to server, and passes everything it receives to listenForSMS
+func startListeningForSMS(t *testing.T, server *fcmtest.Server, databaseConnection db.DatabaseConnection, logger *logrus.Logger) {
+	t.Helper()
+	transport, err := firebasexmpp.NewXMPPTransport(server.XMPPConfig())
+	if err != nil {
+		t.Fatalf("could not connect to server: %s", err)
+	}
+
+	sendChannel := make(chan firebasexmpp.DownstreamPayload, channelBufferSize)
+	upstreamChannel := make(chan firebasexmpp.UpstreamMessage, channelBufferSize)
+	client := firebasexmpp.NewFirebaseClient(
+		"test",
+		transport,
+		upstreamChannel,
+		sendChannel,
+		make(chan firebasexmpp.DeliveryUpdate, channelBufferSize),
+		firebasexmpp.NewRetryScheduler(sendChannel),
+		firebasexmpp.NewUpstreamCache(firebasexmpp.DefaultUpstreamCacheSize),
+		make(chan firebasexmpp.Signal, channelBufferSize),
+		make(chan firebasexmpp.ClientError, channelBufferSize),
+	)
+	go client.StartRecv()
+	t.Cleanup(func() {
+		client.Close()
+	})
+
+	normalizer, err := phonenumber.NewNormalizer("US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventHub := events.NewHub(logger)
+	t.Cleanup(eventHub.Close)
+	go listenForSMS(upstreamChannel, databaseConnection, normalizer, eventHub, logger)
+
+	err = server.WaitForConnections(1, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMessageWithNumberTooLongToStoreIsDroppedAndACKed(t *testing.T) {
+	logger := logrus.New()
+	databaseConnection := newTestDatabase(t, logger)
+	fcmID := "fcm-" + newTestID(t)
+	device := newTestDevice(t, databaseConnection, fcmID)
+
+	server, err := fcmtest.NewServer("123456789", "test-server-key")
+	if err != nil {
+		t.Fatalf("could not start server: %s", err)
+	}
+	t.Cleanup(func() {
+		server.Close()
+	})
+	startListeningForSMS(t, server, databaseConnection, logger)
+
+	//This has too many digits to be normalized, so it is used as a participant as is, and is too long for the threads table
+	err = server.SendUpstream(fcmID, "too-long", map[string]string{
+		"phone_number": strings.Repeat("5", 40),
+		"message":      "hello",
+		"timestamp":    "1500000000",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case messageID := <-server.UpstreamACKs():
+		if messageID != "too-long" {
+			t.Fatalf("unexpected ACK for %s", messageID)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for the message to be ACKed")
+	}
+
+	messages, err := databaseConnection.GetMessages(device.User, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 0 {
+		t.Fatalf("expected the message to be dropped, got %+v", messages)
+	}
+	threads, err := databaseConnection.GetThreads(device.User, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(threads) != 0 {
+		t.Fatalf("expected no thread to be created, got %+v", threads)
+	}
+}
@@ -62,12 +62,14 @@ func ConstructDownstreamSMS(deviceTo []byte, message SMSMessage) (firebasexmpp.D
 		return firebasexmpp.DownstreamPayload{}, err
 	}
 
+	//We request a delivery receipt so that we can tell the user when their message has reached their device.
 	payload := firebasexmpp.DownstreamPayload{
-		To:        string(deviceTo),
-		MessageID: messageID.String(),
-		Priority:  "high",
-		TTL:       3600,
-		Data:      message,
+		To:                       string(deviceTo),
+		MessageID:                messageID.String(),
+		Priority:                 "high",
+		TTL:                      3600,
+		DeliveryReceiptRequested: true,
+		Data:                     message,
 	}
 
 	return payload, nil
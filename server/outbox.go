@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/ollien/sms-pusher/server/db"
+	"github.com/ollien/sms-pusher/server/events"
+	"github.com/ollien/sms-pusher/server/firebasexmpp"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	//outboxPollInterval is how often the outbox is checked for messages whose dispatch was lost, even if nothing new has been queued
+	outboxPollInterval = 30 * time.Second
+	//outboxStaleAfter is how long a claimed message may stay queued before it is dispatched again, and how long an exhausted message may go without a response from FCM before it is given up on
+	outboxStaleAfter = 15 * time.Minute
+	//maxDispatchAttempts is the number of times a message will be dispatched before it is given up on
+	maxDispatchAttempts = 5
+	//outboxBatchSize is the maximum number of messages claimed from the outbox at once
+	outboxBatchSize = 50
+)
+
+var (
+	//runningClaimStatuses are the statuses of the messages the outbox dispatches while the server runs.
+	//Once a message has been sent, it belongs to the client that sent it, and that client's RetryScheduler, until FCM responds; the outbox only takes it back if it can't be sent. This way, the outbox and the RetryScheduler never both send it again.
+	runningClaimStatuses = []db.OutboundStatus{db.QueuedStatus}
+	//startupClaimStatuses are the statuses of the messages the outbox dispatches when the server starts. Nothing is left from the previous run to send them, so every message that FCM has not responded to must be dispatched again.
+	startupClaimStatuses = []db.OutboundStatus{db.QueuedStatus, db.SentStatus, db.RetryingStatus}
+)
+
+//OutboxDispatcher sends messages that have been stored in the outbox to the supervisor's clients.
+//Messages stay in the outbox until FCM responds to them, so that nothing is lost if the XMPP connection or the server goes down.
+type OutboxDispatcher struct {
+	databaseConnection db.DatabaseConnection
+	sendChannel        chan<- firebasexmpp.DownstreamPayload
+	notifyChannel      chan struct{}
+	stopChannel        chan struct{}
+	abandonChannel     chan struct{}
+	doneChannel        chan struct{}
+	eventHub           *events.Hub
+	logger             *logrus.Logger
+}
+
+//NewOutboxDispatcher creates a new OutboxDispatcher that dispatches messages on sendChannel
+func NewOutboxDispatcher(databaseConnection db.DatabaseConnection, sendChannel chan<- firebasexmpp.DownstreamPayload, eventHub *events.Hub, logger *logrus.Logger) OutboxDispatcher {
+	return OutboxDispatcher{
+		databaseConnection: databaseConnection,
+		sendChannel:        sendChannel,
+		//Only one notification needs to be pending at a time; a single pass over the outbox will pick up everything.
+		notifyChannel:  make(chan struct{}, 1),
+		stopChannel:    make(chan struct{}),
+		abandonChannel: make(chan struct{}),
+		doneChannel:    make(chan struct{}),
+		eventHub:       eventHub,
+		logger:         logger,
+	}
+}
+
+//NotifyChannel gets the channel that must be sent on when a message is added to the outbox. Sends should not block; if the channel is full, a pass over the outbox is already pending.
+func (dispatcher OutboxDispatcher) NotifyChannel() chan<- struct{} {
+	return dispatcher.notifyChannel
+}
+
+//Run dispatches messages from the outbox whenever it is notified, and periodically to catch any dispatches that have been lost.
+//Anything left in the outbox from a previous run is dispatched immediately.
+//Exits once Stop is called and the last pass over the outbox is done or abandoned.
+func (dispatcher OutboxDispatcher) Run() {
+	defer close(dispatcher.doneChannel)
+
+	//Whatever was in flight when the server last stopped will never be responded to, so there is no point in waiting for it to go stale.
+	dispatcher.dispatchPending(startupClaimStatuses, time.Now(), dispatcher.stopChannel)
+
+	pollTicker := time.NewTicker(outboxPollInterval)
+	defer pollTicker.Stop()
+	for {
+		select {
+		case <-dispatcher.notifyChannel:
+		case <-pollTicker.C:
+		case <-dispatcher.stopChannel:
+			//Hand off anything queued before stopping, so that it isn't left waiting until the next run
+			dispatcher.dispatchPending(runningClaimStatuses, time.Now().Add(-outboxStaleAfter), dispatcher.abandonChannel)
+			return
+		}
+
+		dispatcher.failExhausted()
+		dispatcher.dispatchPending(runningClaimStatuses, time.Now().Add(-outboxStaleAfter), dispatcher.stopChannel)
+	}
+}
+
+//Stop makes one last pass over the outbox and then stops the dispatcher, blocking until the pass is done. If ctx expires first, the pass is abandoned, and Stop returns once Run has exited.
+//Anything not handed off by then stays in the outbox, and is dispatched when the server next starts. Stop must only be called once, after Run has been started.
+func (dispatcher OutboxDispatcher) Stop(ctx context.Context) error {
+	close(dispatcher.stopChannel)
+	select {
+	case <-dispatcher.doneChannel:
+		return nil
+	case <-ctx.Done():
+		//No client may ever take the rest of the pass, so we can't wait on it; Run must not outlive the database it uses, though.
+		close(dispatcher.abandonChannel)
+		<-dispatcher.doneChannel
+		return ctx.Err()
+	}
+}
+
+//dispatchPending claims messages with the given statuses from the outbox and sends them to the supervisor's clients, until there is nothing left to claim.
+//Messages last dispatched before staleBefore are dispatched again. staleBefore must not move while claiming, or messages claimed in one batch could be claimed again in the next.
+//Dispatching is abandoned once abandonChannel is closed. Messages that were claimed but not handed off stay in the outbox, and are claimed again once they are stale, or when the server next starts.
+func (dispatcher OutboxDispatcher) dispatchPending(statuses []db.OutboundStatus, staleBefore time.Time, abandonChannel <-chan struct{}) {
+	for {
+		messages, err := dispatcher.databaseConnection.ClaimOutboundMessages(outboxBatchSize, statuses, staleBefore, maxDispatchAttempts)
+		if err != nil {
+			dispatcher.logger.Errorf("Could not claim outbound messages: %s", err)
+			return
+		}
+
+		for _, message := range messages {
+			var payload firebasexmpp.DownstreamPayload
+			err = json.Unmarshal(message.Payload, &payload)
+			if err != nil {
+				dispatcher.logger.WithField("message_id", message.ID).Errorf("Could not decode stored payload: %s", err)
+				continue
+			}
+
+			//Blocks until a client has room for the message
+			select {
+			case dispatcher.sendChannel <- payload:
+			case <-abandonChannel:
+				return
+			}
+		}
+
+		if len(messages) < outboxBatchSize {
+			return
+		}
+	}
+}
+
+//failExhausted marks messages that have been dispatched too many times as failed, and notifies their users.
+func (dispatcher OutboxDispatcher) failExhausted() {
+	messages, err := dispatcher.databaseConnection.FailExhaustedOutboundMessages(maxDispatchAttempts, outboxStaleAfter)
+	if err != nil {
+		dispatcher.logger.Errorf("Could not fail exhausted outbound messages: %s", err)
+		return
+	}
+
+	for _, message := range messages {
+		dispatcher.logger.WithField("message_id", message.ID).Warn("Giving up on outbound message")
+		dispatcher.eventHub.Publish(events.NewDeliveryStatusEvent(message))
+	}
+}
@@ -0,0 +1,157 @@
+package phonenumber
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+const (
+	//e164MaxDigits is the maximum number of digits in an E.164 number, including the country code
+	e164MaxDigits = 15
+	//minNationalDigits is the minimum length of a national number that we will normalize. Anything shorter is assumed to be a short code, which has no E.164 form.
+	minNationalDigits = 7
+)
+
+//ErrNotNormalizable is returned when a number can not be converted into E.164 form, such as short codes or alphanumeric sender ids.
+var ErrNotNormalizable = errors.New("phonenumber: number can not be normalized")
+
+//region stores the dialing rules for a region that are needed to convert its national numbers to E.164
+type region struct {
+	countryCode          string
+	trunkPrefix          string
+	internationalPrefix  string
+	nationalNumberDigits int
+}
+
+//regions holds the dialing rules for supported regions, keyed by ISO 3166-1 alpha-2 code.
+//A nationalNumberDigits of zero means that national numbers may vary in length.
+var regions = map[string]region{
+	"US": {countryCode: "1", trunkPrefix: "1", internationalPrefix: "011", nationalNumberDigits: 10},
+	"CA": {countryCode: "1", trunkPrefix: "1", internationalPrefix: "011", nationalNumberDigits: 10},
+	"GB": {countryCode: "44", trunkPrefix: "0", internationalPrefix: "00"},
+	"IE": {countryCode: "353", trunkPrefix: "0", internationalPrefix: "00"},
+	"DE": {countryCode: "49", trunkPrefix: "0", internationalPrefix: "00"},
+	"FR": {countryCode: "33", trunkPrefix: "0", internationalPrefix: "00", nationalNumberDigits: 9},
+	"NL": {countryCode: "31", trunkPrefix: "0", internationalPrefix: "00", nationalNumberDigits: 9},
+	"BE": {countryCode: "32", trunkPrefix: "0", internationalPrefix: "00"},
+	"CH": {countryCode: "41", trunkPrefix: "0", internationalPrefix: "00", nationalNumberDigits: 9},
+	"SE": {countryCode: "46", trunkPrefix: "0", internationalPrefix: "00"},
+	//Spain and Italy have no trunk prefix; Italian landlines keep their leading zero in E.164.
+	"ES": {countryCode: "34", internationalPrefix: "00", nationalNumberDigits: 9},
+	"IT": {countryCode: "39", internationalPrefix: "00"},
+	"AU": {countryCode: "61", trunkPrefix: "0", internationalPrefix: "0011", nationalNumberDigits: 9},
+	"NZ": {countryCode: "64", trunkPrefix: "0", internationalPrefix: "00"},
+	"IN": {countryCode: "91", trunkPrefix: "0", internationalPrefix: "00", nationalNumberDigits: 10},
+	"JP": {countryCode: "81", trunkPrefix: "0", internationalPrefix: "010"},
+}
+
+//Number holds a phone number in both the form it was given in, and its normalized form.
+type Number struct {
+	Raw string
+	//Normalized is the E.164 form of Raw. If Raw could not be normalized, this is Raw with surrounding whitespace removed, so that it is still usable as an identifier.
+	Normalized string
+}
+
+//Normalizer converts phone numbers to E.164, treating numbers without a country code as belonging to its default region.
+type Normalizer struct {
+	defaultRegion region
+	hasRegion     bool
+}
+
+//NewNormalizer creates a Normalizer for the given default region, which must be an ISO 3166-1 alpha-2 code, such as "US".
+//If defaultRegion is empty, only numbers that include a country code can be normalized.
+func NewNormalizer(defaultRegion string) (Normalizer, error) {
+	if defaultRegion == "" {
+		return Normalizer{}, nil
+	}
+
+	regionRules, ok := regions[strings.ToUpper(defaultRegion)]
+	if !ok {
+		return Normalizer{}, fmt.Errorf("phonenumber: unsupported region %s", defaultRegion)
+	}
+
+	return Normalizer{
+		defaultRegion: regionRules,
+		hasRegion:     true,
+	}, nil
+}
+
+//Normalize converts a phone number to E.164 form. ErrNotNormalizable is returned if this is not possible.
+func (normalizer Normalizer) Normalize(rawNumber string) (string, error) {
+	trimmedNumber := strings.TrimSpace(rawNumber)
+	hasPlus := strings.HasPrefix(trimmedNumber, "+")
+	digits := make([]rune, 0, len(trimmedNumber))
+	for _, char := range trimmedNumber {
+		if '0' <= char && char <= '9' {
+			digits = append(digits, char)
+		} else if unicode.IsLetter(char) || unicode.IsDigit(char) {
+			//Alphanumeric sender ids, like those used by businesses, have no E.164 form. E.164 numbers are only ever made of ASCII digits, so we don't try to convert any others.
+			return "", ErrNotNormalizable
+		}
+	}
+
+	number := string(digits)
+	if hasPlus {
+		return makeE164(number)
+	}
+
+	if !normalizer.hasRegion {
+		return "", ErrNotNormalizable
+	}
+
+	regionRules := normalizer.defaultRegion
+	if strings.HasPrefix(number, regionRules.internationalPrefix) {
+		return makeE164(strings.TrimPrefix(number, regionRules.internationalPrefix))
+	}
+
+	nationalNumber := number
+	//Some regions (NANP in particular) let the trunk prefix be omitted, so we only strip it if the number is too long without it.
+	if regionRules.trunkPrefix != "" && strings.HasPrefix(nationalNumber, regionRules.trunkPrefix) {
+		if regionRules.nationalNumberDigits == 0 || len(nationalNumber) == regionRules.nationalNumberDigits+len(regionRules.trunkPrefix) {
+			nationalNumber = strings.TrimPrefix(nationalNumber, regionRules.trunkPrefix)
+		}
+	}
+
+	if len(nationalNumber) < minNationalDigits {
+		return "", ErrNotNormalizable
+	} else if regionRules.nationalNumberDigits != 0 && len(nationalNumber) != regionRules.nationalNumberDigits {
+		return "", ErrNotNormalizable
+	}
+
+	return makeE164(regionRules.countryCode + nationalNumber)
+}
+
+//Parse makes a Number from the given raw number, normalizing it if possible.
+func (normalizer Normalizer) Parse(rawNumber string) Number {
+	normalizedNumber, err := normalizer.Normalize(rawNumber)
+	if err != nil {
+		normalizedNumber = strings.TrimSpace(rawNumber)
+	}
+
+	return Number{
+		Raw:        rawNumber,
+		Normalized: normalizedNumber,
+	}
+}
+
+//ParseAll is a convenience function to call Parse on every number in rawNumbers
+func (normalizer Normalizer) ParseAll(rawNumbers []string) []Number {
+	numbers := make([]Number, 0, len(rawNumbers))
+	for _, rawNumber := range rawNumbers {
+		numbers = append(numbers, normalizer.Parse(rawNumber))
+	}
+
+	return numbers
+}
+
+//makeE164 formats the given digits, which must include the country code, as E.164
+func makeE164(digits string) (string, error) {
+	//No country code is shorter than one digit, and no national number is shorter than minNationalDigits
+	if len(digits) < minNationalDigits+1 || len(digits) > e164MaxDigits || digits[0] == '0' {
+		return "", ErrNotNormalizable
+	}
+
+	return "+" + digits, nil
+}
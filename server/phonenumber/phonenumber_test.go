@@ -0,0 +1,89 @@
+package phonenumber
+
+import (
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name          string
+		defaultRegion string
+		rawNumber     string
+		normalized    string
+		err           error
+	}{
+		{name: "US national number", defaultRegion: "US", rawNumber: "(555) 123-4567", normalized: "+15551234567"},
+		{name: "US national number with trunk prefix", defaultRegion: "US", rawNumber: "1 555 123 4567", normalized: "+15551234567"},
+		{name: "US national number with surrounding whitespace", defaultRegion: "US", rawNumber: "  555.123.4567\n", normalized: "+15551234567"},
+		{name: "US national number that is too short", defaultRegion: "US", rawNumber: "555 123 456", err: ErrNotNormalizable},
+		{name: "GB national number with trunk prefix", defaultRegion: "GB", rawNumber: "020 7946 0958", normalized: "+442079460958"},
+		{name: "lowercase region", defaultRegion: "gb", rawNumber: "020 7946 0958", normalized: "+442079460958"},
+		{name: "IT national number keeps its leading zero", defaultRegion: "IT", rawNumber: "06 1234 5678", normalized: "+390612345678"},
+		{name: "plus prefix", defaultRegion: "US", rawNumber: "+44 20 7946 0958", normalized: "+442079460958"},
+		{name: "plus prefix without a default region", rawNumber: "+1 555 123 4567", normalized: "+15551234567"},
+		{name: "00 international prefix", defaultRegion: "GB", rawNumber: "00 1 555 123 4567", normalized: "+15551234567"},
+		{name: "011 international prefix", defaultRegion: "US", rawNumber: "011 44 20 7946 0958", normalized: "+442079460958"},
+		{name: "national number without a default region", rawNumber: "555 123 4567", err: ErrNotNormalizable},
+		{name: "plus prefix longer than e164MaxDigits", defaultRegion: "US", rawNumber: "+1234567890123456", err: ErrNotNormalizable},
+		{name: "international prefix longer than e164MaxDigits", defaultRegion: "GB", rawNumber: "00 1234567890123456", err: ErrNotNormalizable},
+		{name: "plus prefix with e164MaxDigits", defaultRegion: "US", rawNumber: "+123456789012345", normalized: "+123456789012345"},
+		{name: "country code starting with zero", defaultRegion: "US", rawNumber: "+0123456789", err: ErrNotNormalizable},
+		{name: "short code", defaultRegion: "US", rawNumber: "12345", err: ErrNotNormalizable},
+		{name: "short code with plus prefix", defaultRegion: "US", rawNumber: "+12345", err: ErrNotNormalizable},
+		{name: "short code in a region with variable length numbers", defaultRegion: "GB", rawNumber: "61234", err: ErrNotNormalizable},
+		{name: "alphanumeric sender id", defaultRegion: "US", rawNumber: "AMAZON", err: ErrNotNormalizable},
+		{name: "alphanumeric sender id with digits", defaultRegion: "US", rawNumber: "VERIFY-5551234567", err: ErrNotNormalizable},
+		{name: "fullwidth digits", defaultRegion: "US", rawNumber: "+1 ５５５ 123 4567", err: ErrNotNormalizable},
+		{name: "Arabic-Indic digits", defaultRegion: "US", rawNumber: "+١٥٥٥١٢٣٤٥٦٧", err: ErrNotNormalizable},
+		{name: "empty number", defaultRegion: "US", rawNumber: "", err: ErrNotNormalizable},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			normalizer, err := NewNormalizer(test.defaultRegion)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			normalized, err := normalizer.Normalize(test.rawNumber)
+			if err != test.err {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+			if normalized != test.normalized {
+				t.Fatalf("expected %q, got %q", test.normalized, normalized)
+			}
+		})
+	}
+}
+
+func TestNewNormalizerWithUnsupportedRegion(t *testing.T) {
+	_, err := NewNormalizer("XX")
+	if err == nil {
+		t.Fatal("expected an error for an unsupported region")
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name      string
+		rawNumber string
+		expected  Number
+	}{
+		{name: "normalizable number", rawNumber: "(555) 123-4567", expected: Number{Raw: "(555) 123-4567", Normalized: "+15551234567"}},
+		{name: "alphanumeric sender id is trimmed", rawNumber: " AMAZON ", expected: Number{Raw: " AMAZON ", Normalized: "AMAZON"}},
+		{name: "short code is kept as is", rawNumber: "12345", expected: Number{Raw: "12345", Normalized: "12345"}},
+	}
+
+	normalizer, err := NewNormalizer("US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			number := normalizer.Parse(test.rawNumber)
+			if number != test.expected {
+				t.Fatalf("expected %+v, got %+v", test.expected, number)
+			}
+		})
+	}
+}
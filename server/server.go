@@ -1,20 +1,37 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
 	"github.com/ollien/sms-pusher/server/config"
 	"github.com/ollien/sms-pusher/server/db"
+	"github.com/ollien/sms-pusher/server/events"
+	"github.com/ollien/sms-pusher/server/fcmhttp"
 	"github.com/ollien/sms-pusher/server/firebasexmpp"
+	"github.com/ollien/sms-pusher/server/phonenumber"
 	"github.com/ollien/sms-pusher/server/web"
 	"github.com/sirupsen/logrus"
 )
 
+//httpSenderCount is the number of messages that are sent at once with the HTTP v1 API
+const httpSenderCount = 4
+
 //Server represents a single instance of the sms-pusher server
 type Server struct {
 	databaseConnection db.DatabaseConnection
 	logger             *logrus.Logger
+	eventHub           *events.Hub
+	normalizer         phonenumber.Normalizer
 	upstreamChannel    <-chan firebasexmpp.UpstreamMessage
 	sendChannel        chan<- firebasexmpp.DownstreamPayload
-	supervisor         XMPPSupervisor
+	deliveryChannel    <-chan firebasexmpp.DeliveryUpdate
+	supervisor         *XMPPSupervisor
+	xmppEnabled        bool
+	httpSender         *fcmhttp.Sender
+	outboxDispatcher   OutboxDispatcher
 	webserver          web.Webserver
 }
 
@@ -44,54 +61,120 @@ func NewServer() (Server, error) {
 
 	_, err = setup(databaseConnection)
 	if err != nil {
-		logger.Fatal(err)
+		databaseConnection.Close()
+		return Server{}, err
+	}
+
+	normalizer, err := phonenumber.NewNormalizer(config.Phone.DefaultRegion)
+	if err != nil {
+		return Server{}, err
 	}
 
+	eventHub := events.NewHub(logger)
 	upstreamChannel := make(chan firebasexmpp.UpstreamMessage)
 	sendChannel := make(chan firebasexmpp.DownstreamPayload)
-	supervisor := NewXMPPSupervisor(upstreamChannel, sendChannel, logger)
+	deliveryChannel := make(chan firebasexmpp.DeliveryUpdate)
+	useHTTP, err := config.Downstream.UsesHTTP()
+	if err != nil {
+		return Server{}, err
+	} else if !useHTTP && config.XMPP.Disabled {
+		return Server{}, errors.New("xmpp must be enabled to send downstream messages over it")
+	}
+
+	var httpSender *fcmhttp.Sender
+	//XMPP clients only take from the send channel if they are what sends downstream messages
+	xmppSendChannel := sendChannel
+	if useHTTP {
+		httpSender, err = fcmhttp.NewSender(config.Downstream.HTTP, sendChannel, deliveryChannel, firebasexmpp.NewRetryScheduler(sendChannel))
+		if err != nil {
+			return Server{}, err
+		}
+		xmppSendChannel = nil
+	}
+
+	supervisor := NewXMPPSupervisor(upstreamChannel, xmppSendChannel, deliveryChannel, config.XMPP.GetConnectionCount(), logger)
+	outboxDispatcher := NewOutboxDispatcher(databaseConnection, sendChannel, eventHub, logger)
 
 	listenAddress := config.Web.GetListenAddress()
-	webserver, err := web.NewWebserver(listenAddress, databaseConnection, sendChannel, logger)
+	webserver, err := web.NewWebserver(listenAddress, databaseConnection, outboxDispatcher.NotifyChannel(), eventHub, logger)
 	if err != nil {
 		return Server{}, err
 	}
+	//Streams of events never finish on their own, so the webserver could never shut down without ending them
+	webserver.Server.RegisterOnShutdown(eventHub.Close)
 
 	return Server{
 		databaseConnection: databaseConnection,
 		logger:             logger,
+		eventHub:           eventHub,
+		normalizer:         normalizer,
 		upstreamChannel:    upstreamChannel,
 		sendChannel:        sendChannel,
+		deliveryChannel:    deliveryChannel,
 		supervisor:         supervisor,
+		xmppEnabled:        !config.XMPP.Disabled,
+		httpSender:         httpSender,
+		outboxDispatcher:   outboxDispatcher,
 		webserver:          webserver,
 	}, nil
 }
 
-//Run starts the Server
+//Run starts the Server, blocking until the webserver stops. Returns nil if the webserver was stopped by Shutdown.
 func (server Server) Run() error {
-	err := server.supervisor.SpawnClient()
-	if err != nil {
-		server.logger.Fatalf("Error in starting client: %s", err)
+	if server.httpSender != nil {
+		server.httpSender.Start(httpSenderCount)
+	}
+
+	go listenForSMS(server.upstreamChannel, server.databaseConnection, server.normalizer, server.eventHub, server.logger)
+	go listenForDeliveryUpdates(server.deliveryChannel, server.outboxDispatcher.NotifyChannel(), server.databaseConnection, server.eventHub, server.logger)
+	go server.outboxDispatcher.Run()
+
+	if server.xmppEnabled {
+		err := server.supervisor.Start()
+		if err != nil {
+			return fmt.Errorf("error in starting client: %s", err)
+		}
+	} else {
+		server.logger.Warn("XMPP is disabled; no upstream messages will be received")
 	}
 
-	go listenForSMS(server.upstreamChannel, server.logger)
 	server.logger.Info("Listening for SMS")
 	server.logger.Info("Starting Webserver")
+	err := server.webserver.Server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
 
-	return server.webserver.Server.ListenAndServe()
+	return err
 }
 
-//Stop stops the Server
-func (server Server) Stop() error {
-	err := server.databaseConnection.Close()
-	if err != nil {
-		return err
+//Shutdown gracefully stops the Server. The webserver stops accepting requests, everything queued in the outbox is handed off to be sent, and the HTTP senders and XMPP clients are stopped once FCM has responded to what they have sent.
+//The database is closed last, as everything before it may still be using it. If ctx expires before this is done, whatever is left is abandoned; outbound messages remain in the outbox, and are sent when the server next starts.
+//Every step is performed even if one before it fails. The first error encountered is returned.
+func (server Server) Shutdown(ctx context.Context) error {
+	var shutdownErr error
+	handleErr := func(step string, err error) {
+		if err == nil {
+			return
+		}
+
+		server.logger.Errorf("Could not %s: %s", step, err)
+		if shutdownErr == nil {
+			shutdownErr = err
+		}
 	}
 
-	err = server.webserver.Server.Close()
-	if err != nil {
-		return err
+	server.logger.Info("Stopping Webserver")
+	handleErr("stop webserver", server.webserver.Server.Shutdown(ctx))
+	server.logger.Info("Flushing outbox")
+	handleErr("flush outbox", server.outboxDispatcher.Stop(ctx))
+	if server.httpSender != nil {
+		server.logger.Info("Stopping HTTP senders")
+		handleErr("stop http senders", server.httpSender.Stop(ctx))
 	}
+	server.logger.Info("Closing XMPP clients")
+	handleErr("close xmpp clients", server.supervisor.Shutdown(ctx))
+	handleErr("close database", server.databaseConnection.Close())
 
-	return nil
+	return shutdownErr
 }
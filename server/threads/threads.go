@@ -0,0 +1,35 @@
+package threads
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/ollien/sms-pusher/server/db"
+)
+
+//Participants gets the normalized set of phone numbers that a message's conversation is with. The result is sorted and contains no duplicates, so that two messages in the same conversation always produce the same set.
+//The recipients of an MMS include the device itself. If there is only one recipient, the message is a 1:1 conversation, and the device is left out so that SMS and MMS with the same person share a thread.
+//Group MMS keep every recipient; each message in a group is addressed to the same set of people, so including the device changes nothing.
+func Participants(message db.Message) []string {
+	rawParticipants := []string{message.PhoneNumber}
+	if len(message.Recipients) > 1 {
+		rawParticipants = append(rawParticipants, message.Recipients...)
+	}
+
+	participantSet := make(map[string]struct{}, len(rawParticipants))
+	for _, participant := range rawParticipants {
+		normalizedParticipant := strings.TrimSpace(participant)
+		if normalizedParticipant == "" {
+			continue
+		}
+		participantSet[normalizedParticipant] = struct{}{}
+	}
+
+	participants := make([]string, 0, len(participantSet))
+	for participant := range participantSet {
+		participants = append(participants, participant)
+	}
+	sort.Strings(participants)
+
+	return participants
+}
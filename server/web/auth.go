@@ -0,0 +1,211 @@
+package web
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/ollien/sms-pusher/server/db"
+	uuid "github.com/satori/go.uuid"
+)
+
+//authContextKey is the key that a request's requestAuth is stored under in its context
+type authContextKey struct{}
+
+//authPolicy declares how requests to a route must be authenticated. The zero value allows anyone.
+type authPolicy struct {
+	//allowSession allows a user's session, given as a cookie or the X-Session-ID header
+	allowSession bool
+	//scope, if set, also allows personal access tokens that have been granted it
+	scope string
+	//allowDeviceToken also allows a device's own token, which may only act as that device
+	allowDeviceToken bool
+	//device requires the request to act as one of the authenticated user's devices, given by the device_id form value
+	device bool
+}
+
+var (
+	//publicRoute allows anyone
+	publicRoute = authPolicy{}
+	//sessionRoute only allows a user's session
+	sessionRoute = authPolicy{allowSession: true}
+	//deviceRoute allows a device's own token, or a user's session acting as one of their devices
+	deviceRoute = authPolicy{allowSession: true, allowDeviceToken: true, device: true}
+)
+
+//requestAuth holds who a request has been authenticated as
+type requestAuth struct {
+	user db.User
+	//session is only set if the request was authenticated by a session
+	session db.Session
+	//device is only set if the route's authPolicy requires one
+	device db.Device
+	//byDeviceToken is set if the request was authenticated by a device's own token, in which case device is that device
+	byDeviceToken bool
+}
+
+//scopedRoute allows a user's session, or a personal access token that has been granted the given scope
+func scopedRoute(scope string) authPolicy {
+	return authPolicy{allowSession: true, scope: scope}
+}
+
+//withDevice makes a copy of the policy that also requires the request to act as one of the user's devices
+func (policy authPolicy) withDevice() authPolicy {
+	policy.device = true
+
+	return policy
+}
+
+//authenticateRequest authenticates a request as its route's authPolicy requires, and stores who it was authenticated as in the returned request's context.
+//Requests that change state and are authenticated by the session cookie must also carry the session's CSRF token.
+//If the request can't be authenticated, an error status is written and false is returned.
+func (serv *Webserver) authenticateRequest(writer *LoggableResponseWriter, req *http.Request, policy authPolicy) (*http.Request, bool) {
+	if policy == publicRoute {
+		return req, true
+	}
+
+	var auth requestAuth
+	var ok bool
+	token, hasToken := getBearerToken(req)
+	if hasToken && strings.HasPrefix(token, db.PersonalAccessTokenPrefix) {
+		auth, ok = serv.authenticateAccessToken(writer, token, policy)
+	} else if hasToken {
+		auth, ok = serv.authenticateDeviceToken(writer, req, token, policy)
+	} else {
+		auth, ok = serv.authenticateSession(writer, req, policy)
+	}
+	if !ok {
+		return req, false
+	}
+
+	//A request authenticated by a device token already has its device
+	if policy.device && !auth.byDeviceToken {
+		auth.device, ok = serv.authorizeDevice(writer, req, auth.user)
+		if !ok {
+			return req, false
+		}
+	}
+
+	return req.WithContext(context.WithValue(req.Context(), authContextKey{}, auth)), true
+}
+
+//authenticateAccessToken authenticates a request by a personal access token
+func (serv *Webserver) authenticateAccessToken(writer *LoggableResponseWriter, token string, policy authPolicy) (requestAuth, bool) {
+	if policy.scope == "" {
+		writer.setResponseReason("Personal access tokens can't be used for this route")
+		writer.WriteHeader(http.StatusUnauthorized)
+		return requestAuth{}, false
+	}
+
+	accessToken, err := serv.routeHandler.databaseConnection.GetPersonalAccessToken(token)
+	if err != nil {
+		writer.setResponseErrorReason(err)
+		setStatusTo500IfDatabaseFault(writer, err, http.StatusUnauthorized)
+		return requestAuth{}, false
+	}
+	if !accessToken.HasScope(policy.scope) {
+		writer.setResponseReason("Personal access token does not have the " + policy.scope + " scope")
+		writer.WriteHeader(http.StatusForbidden)
+		return requestAuth{}, false
+	}
+
+	return requestAuth{user: accessToken.User}, true
+}
+
+//authenticateDeviceToken authenticates a request by a device's own token. The device_id form value is redundant with a token, but if it is given, it must be the device's own.
+func (serv *Webserver) authenticateDeviceToken(writer *LoggableResponseWriter, req *http.Request, token string, policy authPolicy) (requestAuth, bool) {
+	if !policy.allowDeviceToken {
+		writer.setResponseReason("Device tokens can't be used for this route")
+		writer.WriteHeader(http.StatusUnauthorized)
+		return requestAuth{}, false
+	}
+
+	device, err := serv.routeHandler.databaseConnection.GetDeviceByToken(token)
+	if err != nil {
+		writer.setResponseErrorReason(err)
+		setStatusTo500IfDatabaseFault(writer, err, http.StatusUnauthorized)
+		return requestAuth{}, false
+	}
+
+	deviceID := req.FormValue("device_id")
+	if deviceID != "" && deviceID != device.ID.String() {
+		writer.WriteHeader(http.StatusForbidden)
+		return requestAuth{}, false
+	}
+
+	return requestAuth{user: device.User, device: device, byDeviceToken: true}, true
+}
+
+//authenticateSession authenticates a request by a user's session
+func (serv *Webserver) authenticateSession(writer *LoggableResponseWriter, req *http.Request, policy authPolicy) (requestAuth, bool) {
+	if !policy.allowSession {
+		writer.setResponseReason("Sessions can't be used for this route")
+		writer.WriteHeader(http.StatusUnauthorized)
+		return requestAuth{}, false
+	}
+
+	_, fromCookie, err := getRequestSessionID(req)
+	if err != nil {
+		writer.setResponseErrorReason(err)
+		writer.WriteHeader(http.StatusUnauthorized)
+		return requestAuth{}, false
+	}
+
+	session, err := GetRequestSession(serv.routeHandler.databaseConnection, req)
+	if err != nil {
+		writer.setResponseErrorReason(err)
+		setStatusTo500IfDatabaseFault(writer, err, http.StatusUnauthorized)
+		return requestAuth{}, false
+	}
+
+	//Only a cookie is sent by the browser on its own, so only then could the request have been forged by another site
+	if fromCookie && !isSafeMethod(req.Method) {
+		csrfToken := getRequestCSRFToken(req)
+		if csrfToken == "" || subtle.ConstantTimeCompare([]byte(csrfToken), []byte(session.CSRFToken)) != 1 {
+			writer.setResponseReason("Missing or invalid CSRF token")
+			writer.WriteHeader(http.StatusForbidden)
+			return requestAuth{}, false
+		}
+	}
+
+	return requestAuth{user: session.User, session: session}, true
+}
+
+//authorizeDevice gets the device given by a request's device_id form value, checking that it belongs to the user
+func (serv *Webserver) authorizeDevice(writer *LoggableResponseWriter, req *http.Request, user db.User) (db.Device, bool) {
+	deviceID := req.FormValue("device_id")
+	if deviceID == "" {
+		writer.setResponseReason(notEnoughInfoErrorLogMsg)
+		writer.WriteHeader(http.StatusBadRequest)
+		return db.Device{}, false
+	}
+
+	deviceUUID, err := uuid.FromString(deviceID)
+	if err != nil {
+		writer.setResponseErrorReason(err)
+		writer.WriteHeader(http.StatusBadRequest)
+		return db.Device{}, false
+	}
+
+	device, err := serv.routeHandler.databaseConnection.GetDevice(deviceUUID)
+	if err != nil {
+		writer.setResponseErrorReason(err)
+		setStatusTo500IfDatabaseFault(writer, err, http.StatusNotFound)
+		return db.Device{}, false
+	}
+	if device.User.ID != user.ID {
+		writer.setResponseErrorReason(errors.New("device belongs to another user"))
+		writer.WriteHeader(http.StatusForbidden)
+		return db.Device{}, false
+	}
+
+	return device, true
+}
+
+//getRequestAuth gets who a request was authenticated as. It must only be used by handlers for routes that aren't public.
+func getRequestAuth(req *http.Request) requestAuth {
+	//The auth is always stored for routes that aren't public, so a missing one is a bug in the route's declaration
+	return req.Context().Value(authContextKey{}).(requestAuth)
+}
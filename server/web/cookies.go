@@ -0,0 +1,65 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/ollien/sms-pusher/server/config"
+	"github.com/ollien/sms-pusher/server/db"
+)
+
+//sessionCookieName is the name of the cookie that holds a browser's session id
+const sessionCookieName = "session"
+
+//cookieSettings holds the attributes that the session cookie is set with
+type cookieSettings struct {
+	secure   bool
+	sameSite http.SameSite
+	domain   string
+	path     string
+}
+
+//newCookieSettings makes cookieSettings from the cookie config. Returns an error if the config is invalid.
+func newCookieSettings(cookieConfig config.CookieConfig) (cookieSettings, error) {
+	sameSite, err := cookieConfig.GetSameSite()
+	if err != nil {
+		return cookieSettings{}, err
+	}
+
+	return cookieSettings{
+		secure:   cookieConfig.Secure,
+		sameSite: sameSite,
+		domain:   cookieConfig.Domain,
+		path:     cookieConfig.GetPath(),
+	}, nil
+}
+
+//makeSessionCookie makes the cookie that holds the given session.
+//The cookie expires when the session would if it went unused, so a browser must authenticate again once the session's original lifetime has passed.
+func (settings cookieSettings) makeSessionCookie(session db.Session) *http.Cookie {
+	cookie := settings.makeCookie()
+	cookie.Value = session.ID.String()
+	cookie.Expires = session.ExpiresAt
+
+	return cookie
+}
+
+//makeClearedSessionCookie makes a cookie that tells the client to remove its session cookie
+func (settings cookieSettings) makeClearedSessionCookie() *http.Cookie {
+	cookie := settings.makeCookie()
+	cookie.MaxAge = -1
+
+	return cookie
+}
+
+//makeCookie makes an empty session cookie with all of the configured attributes
+//The attributes must match exactly between setting and clearing the cookie, or the browser will treat them as different cookies.
+func (settings cookieSettings) makeCookie() *http.Cookie {
+	return &http.Cookie{
+		Name:     sessionCookieName,
+		Path:     settings.path,
+		Domain:   settings.domain,
+		Secure:   settings.secure,
+		HttpOnly: true,
+		SameSite: settings.sameSite,
+	}
+}
@@ -5,26 +5,61 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/ollien/sms-pusher/server/config"
 	"github.com/ollien/sms-pusher/server/db"
-	"github.com/ollien/sms-pusher/server/firebasexmpp"
+	"github.com/ollien/sms-pusher/server/events"
 	"github.com/ollien/sms-pusher/server/messaging"
+	"github.com/ollien/sms-pusher/server/phonenumber"
 	uuid "github.com/satori/go.uuid"
 )
 
 const (
 	notEnoughInfoErrorLogMsg = "Not enough info to continue."
+	//maxAccessTokenNameLength is the longest name a personal access token may have, as limited by the database
+	maxAccessTokenNameLength       = 64
+	defaultAccessTokenLifetimeDays = 90
+	maxAccessTokenLifetimeDays     = 365
 )
 
+//accessTokenData represents a personal access token. Used for marshalling JSON.
+type accessTokenData struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+}
+
+//newAccessTokenData converts a db.PersonalAccessToken to an accessTokenData
+func newAccessTokenData(accessToken db.PersonalAccessToken) accessTokenData {
+	data := accessTokenData{
+		ID:        accessToken.ID,
+		Name:      accessToken.Name,
+		Scopes:    accessToken.Scopes,
+		CreatedAt: accessToken.CreatedAt,
+		ExpiresAt: accessToken.ExpiresAt,
+	}
+	//A token that has never been used is given a null last_used_at
+	if !accessToken.LastUsedAt.IsZero() {
+		data.LastUsedAt = &accessToken.LastUsedAt
+	}
+
+	return data
+}
+
 //RouteHandler holds all routes and allows them to share common variables
 type RouteHandler struct {
 	databaseConnection db.DatabaseConnection
-	sendChannel        chan<- firebasexmpp.DownstreamPayload
+	outboxChannel      chan<- struct{}
+	eventHub           *events.Hub
+	normalizer         phonenumber.Normalizer
+	cookieSettings     cookieSettings
 	logger             routeLogger
-	//TODO: add sendErrorChannel once websockets are implemented
 }
 
 func (handler RouteHandler) index(writer *LoggableResponseWriter, req *http.Request, params httprouter.Params) {
@@ -32,13 +67,6 @@ func (handler RouteHandler) index(writer *LoggableResponseWriter, req *http.Requ
 }
 
 func (handler RouteHandler) register(writer *LoggableResponseWriter, req *http.Request, params httprouter.Params) {
-	_, err := GetSessionUser(handler.databaseConnection, req)
-	if err != nil {
-		writer.setResponseErrorReason(err)
-		setStatusTo500IfDatabaseFault(writer, err, http.StatusUnauthorized)
-		return
-	}
-
 	username := req.FormValue("username")
 	password := req.FormValue("password")
 	if username == "" || password == "" || len(password) < 8 {
@@ -49,7 +77,7 @@ func (handler RouteHandler) register(writer *LoggableResponseWriter, req *http.R
 	}
 
 	encodedPassword := []byte(password)
-	err = handler.databaseConnection.CreateUser(username, encodedPassword)
+	err := handler.databaseConnection.CreateUser(username, encodedPassword)
 	if err != nil {
 		//Postgres specific check
 		if err.Error() == db.DuplicateUserError {
@@ -64,10 +92,10 @@ func (handler RouteHandler) register(writer *LoggableResponseWriter, req *http.R
 }
 
 func (handler RouteHandler) authenticate(writer *LoggableResponseWriter, req *http.Request, params httprouter.Params) {
-	user, err := GetSessionUser(handler.databaseConnection, req)
-	//If there is no error, we found a user, and can return a 200
+	session, err := GetRequestSession(handler.databaseConnection, req)
+	//If there is no error, we found a valid session, and can return a 200 with its CSRF token
 	if err == nil {
-		//If there is a valid session, we have a 200, which is already the default header, so we just reurn.
+		writeCSRFTokenResponse(writer, session)
 		return
 	}
 
@@ -80,14 +108,14 @@ func (handler RouteHandler) authenticate(writer *LoggableResponseWriter, req *ht
 	}
 
 	encodedPassword := []byte(password)
-	user, err = handler.databaseConnection.VerifyUser(username, encodedPassword)
+	user, err := handler.databaseConnection.VerifyUser(username, encodedPassword)
 	if err != nil {
 		writer.setResponseErrorReason(err)
 		setStatusTo500IfDatabaseFault(writer, err, http.StatusUnauthorized)
 		return
 	}
 
-	session, err := handler.databaseConnection.CreateSession(user)
+	session, err = handler.databaseConnection.CreateSession(user, req.UserAgent(), getClientIP(req))
 	if err != nil {
 		//We don't need to handle DatabaseFault since we 500 anyway.
 		writer.setResponseErrorReason(err)
@@ -95,23 +123,33 @@ func (handler RouteHandler) authenticate(writer *LoggableResponseWriter, req *ht
 		return
 	}
 
-	cookie := &http.Cookie{
-		Name:  "session",
-		Value: session.ID.String(),
-	}
+	http.SetCookie(writer, handler.cookieSettings.makeSessionCookie(session))
+	writeCSRFTokenResponse(writer, session)
+}
+
+func (handler RouteHandler) getCSRFToken(writer *LoggableResponseWriter, req *http.Request, params httprouter.Params) {
+	session := getRequestAuth(req).session
 
-	http.SetCookie(writer, cookie)
+	writeCSRFTokenResponse(writer, session)
 }
 
-func (handler RouteHandler) registerDevice(writer *LoggableResponseWriter, req *http.Request, params httprouter.Params) {
-	user, err := GetSessionUser(handler.databaseConnection, req)
+func (handler RouteHandler) logout(writer *LoggableResponseWriter, req *http.Request, params httprouter.Params) {
+	session := getRequestAuth(req).session
+
+	err := handler.databaseConnection.DeleteSession(session.User, session.ID)
 	if err != nil {
 		writer.setResponseErrorReason(err)
 		setStatusTo500IfDatabaseFault(writer, err, http.StatusUnauthorized)
 		return
 	}
 
-	deviceID, err := handler.databaseConnection.RegisterDeviceToUser(user)
+	http.SetCookie(writer, handler.cookieSettings.makeClearedSessionCookie())
+}
+
+func (handler RouteHandler) getSessions(writer *LoggableResponseWriter, req *http.Request, params httprouter.Params) {
+	currentSession := getRequestAuth(req).session
+
+	userSessions, err := handler.databaseConnection.GetSessions(currentSession.User)
 	if err != nil {
 		//We don't need to handle DatabaseFault since we 500 anyway
 		writer.setResponseErrorReason(err)
@@ -119,48 +157,107 @@ func (handler RouteHandler) registerDevice(writer *LoggableResponseWriter, req *
 		return
 	}
 
+	type sessionData struct {
+		ID         string    `json:"id"`
+		Current    bool      `json:"current"`
+		UserAgent  string    `json:"user_agent"`
+		IPAddress  string    `json:"ip_address"`
+		CreatedAt  time.Time `json:"created_at"`
+		LastSeenAt time.Time `json:"last_seen_at"`
+		ExpiresAt  time.Time `json:"expires_at"`
+	}
 	rawRes := struct {
-		DeviceID string `json:"device_id"`
-	}{deviceID.ID.String()}
-	resultJSON, err := json.Marshal(rawRes)
+		Sessions []sessionData `json:"sessions"`
+	}{Sessions: make([]sessionData, 0, len(userSessions))}
+	for _, session := range userSessions {
+		rawRes.Sessions = append(rawRes.Sessions, sessionData{
+			ID:         session.ID.String(),
+			Current:    uuid.Equal(session.ID, currentSession.ID),
+			UserAgent:  session.UserAgent,
+			IPAddress:  session.IPAddress,
+			CreatedAt:  session.CreatedAt,
+			LastSeenAt: session.LastSeenAt,
+			ExpiresAt:  session.ExpiresAt,
+		})
+	}
+
+	writeJSONResponse(writer, rawRes)
+}
+
+func (handler RouteHandler) deleteSession(writer *LoggableResponseWriter, req *http.Request, params httprouter.Params) {
+	currentSession := getRequestAuth(req).session
+
+	sessionID, err := uuid.FromString(params.ByName("id"))
 	if err != nil {
 		writer.setResponseErrorReason(err)
-		writer.WriteHeader(http.StatusInternalServerError)
-	} else {
-		_, err := writer.Write(resultJSON)
-		if err != nil {
-			handler.logger.logWithField(req, "json", string(resultJSON)).Debug(err)
-			writer.setResponseErrorReason(err)
-			writer.WriteHeader(http.StatusInternalServerError)
-		}
+		writer.WriteHeader(http.StatusBadRequest)
+		return
 	}
-}
 
-func (handler RouteHandler) setFCMID(writer *LoggableResponseWriter, req *http.Request, params httprouter.Params) {
-	user, err := GetSessionUser(handler.databaseConnection, req)
+	//Sessions belonging to other users are not found, so that their IDs can't be probed for
+	err = handler.databaseConnection.DeleteSession(currentSession.User, sessionID)
 	if err != nil {
 		writer.setResponseErrorReason(err)
-		setStatusTo500IfDatabaseFault(writer, err, http.StatusUnauthorized)
+		setStatusTo500IfDatabaseFault(writer, err, http.StatusNotFound)
 		return
 	}
 
-	deviceID := req.FormValue("device_id")
-	fcmID := req.FormValue("fcm_id")
-	if deviceID == "" || fcmID == "" {
+	if uuid.Equal(sessionID, currentSession.ID) {
+		http.SetCookie(writer, handler.cookieSettings.makeClearedSessionCookie())
+	}
+}
+
+func (handler RouteHandler) createAccessToken(writer *LoggableResponseWriter, req *http.Request, params httprouter.Params) {
+	user := getRequestAuth(req).user
+
+	name := req.FormValue("name")
+	scopes := req.Form["scope"]
+	if name == "" || len(name) > maxAccessTokenNameLength || len(scopes) == 0 {
 		writer.setResponseReason(notEnoughInfoErrorLogMsg)
 		writer.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	for _, scope := range scopes {
+		if !validScopes[scope] {
+			writer.setResponseReason("Unknown scope " + scope)
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	expiresInDays := defaultAccessTokenLifetimeDays
+	rawExpiresInDays := req.FormValue("expires_in_days")
+	if rawExpiresInDays != "" {
+		var err error
+		expiresInDays, err = strconv.Atoi(rawExpiresInDays)
+		if err != nil || expiresInDays <= 0 || expiresInDays > maxAccessTokenLifetimeDays {
+			writer.setResponseReason("Invalid expiry")
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
 
-	deviceUUID, err := uuid.FromString(deviceID)
+	expiresAt := time.Now().AddDate(0, 0, expiresInDays)
+	accessToken, token, err := handler.databaseConnection.CreatePersonalAccessToken(user, name, scopes, expiresAt)
 	if err != nil {
+		//The only error that isn't a DatabaseFault is a duplicate name
 		writer.setResponseErrorReason(err)
-		writer.WriteHeader(http.StatusBadRequest)
+		setStatusTo500IfDatabaseFault(writer, err, http.StatusConflict)
 		return
 	}
 
-	//Check to make sure that the user is actually modifying their device
-	device, err := handler.databaseConnection.GetDevice(deviceUUID)
+	//The token is only ever shown here, as only its hash is stored
+	rawRes := struct {
+		accessTokenData
+		Token string `json:"token"`
+	}{newAccessTokenData(accessToken), token}
+	writeJSONResponseWithStatus(writer, http.StatusCreated, rawRes)
+}
+
+func (handler RouteHandler) getAccessTokens(writer *LoggableResponseWriter, req *http.Request, params httprouter.Params) {
+	user := getRequestAuth(req).user
+
+	userAccessTokens, err := handler.databaseConnection.GetPersonalAccessTokens(user)
 	if err != nil {
 		//We don't need to handle DatabaseFault since we 500 anyway
 		writer.setResponseErrorReason(err)
@@ -168,57 +265,151 @@ func (handler RouteHandler) setFCMID(writer *LoggableResponseWriter, req *http.R
 		return
 	}
 
-	if device.User.ID != user.ID {
-		writer.WriteHeader(http.StatusForbidden)
+	rawRes := struct {
+		Tokens []accessTokenData `json:"tokens"`
+	}{Tokens: make([]accessTokenData, 0, len(userAccessTokens))}
+	for _, accessToken := range userAccessTokens {
+		rawRes.Tokens = append(rawRes.Tokens, newAccessTokenData(accessToken))
+	}
+
+	writeJSONResponse(writer, rawRes)
+}
+
+func (handler RouteHandler) deleteAccessToken(writer *LoggableResponseWriter, req *http.Request, params httprouter.Params) {
+	user := getRequestAuth(req).user
+
+	accessTokenID, err := strconv.Atoi(params.ByName("id"))
+	if err != nil {
+		writer.setResponseErrorReason(err)
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = handler.databaseConnection.DeletePersonalAccessToken(user, accessTokenID)
+	if err != nil {
+		writer.setResponseErrorReason(err)
+		setStatusTo500IfDatabaseFault(writer, err, http.StatusNotFound)
 		return
 	}
+}
 
-	err = handler.databaseConnection.RegisterFCMID(deviceUUID, []byte(fcmID))
+func (handler RouteHandler) registerDevice(writer *LoggableResponseWriter, req *http.Request, params httprouter.Params) {
+	user := getRequestAuth(req).user
+
+	deviceID, deviceToken, err := handler.databaseConnection.RegisterDeviceToUser(user)
 	if err != nil {
 		//We don't need to handle DatabaseFault since we 500 anyway
 		writer.setResponseErrorReason(err)
 		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	handler.eventHub.Publish(events.NewDeviceStatusEvent(user, deviceID.ID, events.DeviceRegisteredStatus))
+
+	//The device should authenticate with its token from now on, rather than the user's session
+	rawRes := struct {
+		DeviceID    string `json:"device_id"`
+		DeviceToken string `json:"device_token"`
+	}{deviceID.ID.String(), deviceToken}
+	resultJSON, err := json.Marshal(rawRes)
+	if err != nil {
+		writer.setResponseErrorReason(err)
+		writer.WriteHeader(http.StatusInternalServerError)
+	} else {
+		_, err := writer.Write(resultJSON)
+		if err != nil {
+			handler.logger.logWithField(req, "json", string(resultJSON)).Debug(err)
+			writer.setResponseErrorReason(err)
+			writer.WriteHeader(http.StatusInternalServerError)
+		}
 	}
 }
 
-func (handler RouteHandler) sendMessage(writer *LoggableResponseWriter, req *http.Request, params httprouter.Params) {
-	user, err := GetSessionUser(handler.databaseConnection, req)
+func (handler RouteHandler) issueDeviceToken(writer *LoggableResponseWriter, req *http.Request, params httprouter.Params) {
+	user := getRequestAuth(req).user
+
+	deviceID, err := uuid.FromString(params.ByName("id"))
 	if err != nil {
 		writer.setResponseErrorReason(err)
-		setStatusTo500IfDatabaseFault(writer, err, http.StatusUnauthorized)
+		writer.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	recipient := req.FormValue("recipient")
-	message := req.FormValue("message")
-	deviceID := req.FormValue("device_id")
-	if recipient == "" || message == "" || deviceID == "" {
-		writer.setResponseReason(notEnoughInfoErrorLogMsg)
-		//TODO: Return data explaining why a 400 was returned
+	deviceToken, err := handler.databaseConnection.IssueDeviceToken(user, deviceID)
+	if err != nil {
+		writer.setResponseErrorReason(err)
+		setStatusTo500IfDatabaseFault(writer, err, http.StatusNotFound)
+		return
+	}
+
+	rawRes := struct {
+		DeviceToken string `json:"device_token"`
+	}{deviceToken}
+	writeJSONResponse(writer, rawRes)
+}
+
+func (handler RouteHandler) revokeDeviceToken(writer *LoggableResponseWriter, req *http.Request, params httprouter.Params) {
+	user := getRequestAuth(req).user
+
+	deviceID, err := uuid.FromString(params.ByName("id"))
+	if err != nil {
+		writer.setResponseErrorReason(err)
 		writer.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	deviceUUID, err := uuid.FromString(deviceID)
+	err = handler.databaseConnection.RevokeDeviceToken(user, deviceID)
 	if err != nil {
+		writer.setResponseErrorReason(err)
+		setStatusTo500IfDatabaseFault(writer, err, http.StatusNotFound)
+		return
+	}
+}
+
+func (handler RouteHandler) setFCMID(writer *LoggableResponseWriter, req *http.Request, params httprouter.Params) {
+	device := getRequestAuth(req).device
+
+	fcmID := req.FormValue("fcm_id")
+	if fcmID == "" {
+		writer.setResponseReason(notEnoughInfoErrorLogMsg)
 		writer.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	device, err := handler.databaseConnection.GetDevice(deviceUUID)
+	err := handler.databaseConnection.RegisterFCMID(device.ID, []byte(fcmID))
 	if err != nil {
-		//We don't to handle DatabaseFault since we 500 anyway
+		//We don't need to handle DatabaseFault since we 500 anyway
+		writer.setResponseErrorReason(err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	handler.eventHub.Publish(events.NewDeviceStatusEvent(device.User, device.ID, events.DeviceFCMIDUpdatedStatus))
+}
+
+func (handler RouteHandler) sendMessage(writer *LoggableResponseWriter, req *http.Request, params httprouter.Params) {
+	device := getRequestAuth(req).device
+
+	recipient := req.FormValue("recipient")
+	message := req.FormValue("message")
+	if recipient == "" || message == "" {
 		writer.setResponseReason(notEnoughInfoErrorLogMsg)
+		//TODO: Return data explaining why a 400 was returned
 		writer.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	if device.User.ID != user.ID {
-		writer.WriteHeader(http.StatusForbidden)
+
+	//A device without an FCM id either never registered one, or had it rejected by FCM. Either way, there's nowhere to send to.
+	if len(device.FCMID) == 0 {
+		writer.setResponseReason("Device has no FCM id")
+		writer.WriteHeader(http.StatusConflict)
 		return
 	}
 
+	//The device will happily send to a number in any format, but the normalized form is what we group threads by.
+	recipientNumber := handler.normalizer.Parse(recipient)
 	smsMessage := messaging.SMSMessage{
-		PhoneNumber: recipient,
+		PhoneNumber: recipientNumber.Normalized,
 		Message:     message,
 		Timestamp:   time.Now().Unix(),
 	}
@@ -229,51 +420,74 @@ func (handler RouteHandler) sendMessage(writer *LoggableResponseWriter, req *htt
 		return
 	}
 
-	handler.sendChannel <- downstreamMessage
-}
-
-func (handler RouteHandler) uploadMMSFile(writer *LoggableResponseWriter, req *http.Request, params httprouter.Params) {
-	user, err := GetSessionUser(handler.databaseConnection, req)
+	payload, err := json.Marshal(downstreamMessage)
 	if err != nil {
 		writer.setResponseErrorReason(err)
-		setStatusTo500IfDatabaseFault(writer, err, http.StatusUnauthorized)
-		return
-	}
-
-	b64 := req.FormValue("data")
-	deviceID := req.FormValue("device_id")
-	submittedBlockID := req.FormValue("block_id")
-	if b64 == "" || deviceID == "" {
-		writer.setResponseReason(notEnoughInfoErrorLogMsg)
-		writer.WriteHeader(http.StatusBadRequest)
+		writer.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	//Get the device's ID as a UUID and check if it matches the user in the database
-	deviceUUID, err := uuid.FromString(deviceID)
+	//The message goes into the outbox rather than straight to FCM, so that it isn't lost if we can't send it right now.
+	outboundMessage, err := handler.databaseConnection.RecordOutboundMessage(device, db.OutboundMessage{
+		ID:             downstreamMessage.MessageID,
+		PhoneNumber:    recipientNumber.Normalized,
+		RawPhoneNumber: recipientNumber.Raw,
+		Body:           message,
+		Payload:        payload,
+	})
 	if err != nil {
 		//We don't need to handle DatabaseFault since we 500 anyway
 		writer.setResponseErrorReason(err)
 		writer.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	device, err := handler.databaseConnection.GetDevice(deviceUUID)
+
+	handler.eventHub.Publish(events.NewDeliveryStatusEvent(outboundMessage))
+	//If the dispatcher already has a notification pending, it will pick this message up anyway.
+	select {
+	case handler.outboxChannel <- struct{}{}:
+	default:
+	}
+
+	rawRes := struct {
+		MessageID string `json:"message_id"`
+	}{outboundMessage.ID}
+	writeJSONResponseWithStatus(writer, http.StatusAccepted, rawRes)
+}
+
+func (handler RouteHandler) getMessageStatus(writer *LoggableResponseWriter, req *http.Request, params httprouter.Params) {
+	user := getRequestAuth(req).user
+
+	outboundMessage, err := handler.databaseConnection.GetOutboundMessage(params.ByName("message_id"))
 	if err != nil {
-		//We don't need to handle DatabaseFault since we 500 anyway
 		writer.setResponseErrorReason(err)
-		writer.WriteHeader(http.StatusInternalServerError)
+		setStatusTo500IfDatabaseFault(writer, err, http.StatusNotFound)
 		return
 	}
-	if device.User.ID != user.ID {
-		writer.setResponseErrorReason(err)
+	if outboundMessage.UserID != user.ID {
 		writer.WriteHeader(http.StatusForbidden)
 		return
 	}
 
+	writeJSONResponse(writer, events.NewOutboundMessageData(outboundMessage))
+}
+
+func (handler RouteHandler) uploadMMSFile(writer *LoggableResponseWriter, req *http.Request, params httprouter.Params) {
+	device := getRequestAuth(req).device
+
+	b64 := req.FormValue("data")
+	submittedBlockID := req.FormValue("block_id")
+	if b64 == "" {
+		writer.setResponseReason(notEnoughInfoErrorLogMsg)
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
 	//If we don't have a block ID, make a new file block. Otherwuse, use the one we're given.
 	var blockID uuid.UUID
+	var err error
 	if submittedBlockID == "" {
-		blockID, err = handler.databaseConnection.MakeFileBlock(user)
+		blockID, err = handler.databaseConnection.MakeFileBlock(device.User)
 		if err != nil {
 			//We don't need to handle DatabaseFault since we 500 anyway
 			writer.setResponseErrorReason(err)
@@ -284,7 +498,7 @@ func (handler RouteHandler) uploadMMSFile(writer *LoggableResponseWriter, req *h
 		blockID, err = uuid.FromString(submittedBlockID)
 		if err != nil {
 			writer.setResponseErrorReason(err)
-			writer.WriteHeader(http.StatusInternalServerError)
+			writer.WriteHeader(http.StatusBadRequest)
 			return
 		}
 	}
@@ -324,3 +538,148 @@ func (handler RouteHandler) uploadMMSFile(writer *LoggableResponseWriter, req *h
 
 	writer.Write(res)
 }
+
+func (handler RouteHandler) openWebsocket(writer *LoggableResponseWriter, req *http.Request, params httprouter.Params) {
+	user := getRequestAuth(req).user
+
+	conn, err := websocketUpgrader.Upgrade(writer, req, nil)
+	if err != nil {
+		//Upgrade will have already written an error status to the client.
+		writer.setResponseErrorReason(err)
+		return
+	}
+
+	subscription := handler.eventHub.Subscribe(user.ID)
+	session := newWebsocketSession(conn, subscription, handler.logger)
+	//Blocks until the client disconnects
+	session.run(req)
+}
+
+func (handler RouteHandler) streamEvents(writer *LoggableResponseWriter, req *http.Request, params httprouter.Params) {
+	user := getRequestAuth(req).user
+
+	//Last-Event-ID is only ever set to the id of a stored message, so anything else is a bad request
+	lastEventID := 0
+	rawLastEventID := req.Header.Get("Last-Event-ID")
+	if rawLastEventID != "" {
+		var err error
+		lastEventID, err = strconv.Atoi(rawLastEventID)
+		if err != nil {
+			writer.setResponseErrorReason(err)
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	//We must subscribe before we look up any missed messages, so that nothing is lost between the two.
+	subscription := handler.eventHub.Subscribe(user.ID)
+	defer subscription.Close()
+	stream := newEventStream(writer, req, subscription, handler.logger)
+	if rawLastEventID != "" {
+		missedMessages, err := handler.databaseConnection.GetMessagesSince(user, lastEventID, maxReplayedEvents)
+		if err != nil {
+			writer.setResponseErrorReason(err)
+			writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		stream.replay(missedMessages)
+	}
+
+	//Blocks until the client disconnects
+	stream.run()
+}
+
+func (handler RouteHandler) getThreads(writer *LoggableResponseWriter, req *http.Request, params httprouter.Params) {
+	user := getRequestAuth(req).user
+
+	cursor, limit, err := getPageParameters(req)
+	if err != nil {
+		writer.setResponseErrorReason(err)
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	userThreads, err := handler.databaseConnection.GetThreads(user, cursor, limit)
+	if err != nil {
+		//We don't need to handle DatabaseFault since we 500 anyway
+		writer.setResponseErrorReason(err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	type threadData struct {
+		ID            int       `json:"id"`
+		Participants  []string  `json:"participants"`
+		LastMessageID int       `json:"last_message_id"`
+		UpdatedAt     time.Time `json:"updated_at"`
+	}
+	rawRes := struct {
+		Threads    []threadData `json:"threads"`
+		NextCursor string       `json:"next_cursor,omitempty"`
+	}{Threads: make([]threadData, 0, len(userThreads))}
+	for _, thread := range userThreads {
+		rawRes.Threads = append(rawRes.Threads, threadData{
+			ID:            thread.ID,
+			Participants:  thread.Participants,
+			LastMessageID: thread.LastMessageID,
+			UpdatedAt:     thread.UpdatedAt,
+		})
+	}
+	//Threads are ordered by their last message, so that is what the next page must start before.
+	if len(userThreads) == limit {
+		rawRes.NextCursor = strconv.Itoa(userThreads[len(userThreads)-1].LastMessageID)
+	}
+
+	writeJSONResponse(writer, rawRes)
+}
+
+func (handler RouteHandler) getThreadMessages(writer *LoggableResponseWriter, req *http.Request, params httprouter.Params) {
+	user := getRequestAuth(req).user
+
+	threadID, err := strconv.Atoi(params.ByName("id"))
+	if err != nil {
+		writer.setResponseErrorReason(err)
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	cursor, limit, err := getPageParameters(req)
+	if err != nil {
+		writer.setResponseErrorReason(err)
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	thread, err := handler.databaseConnection.GetThread(threadID)
+	if err != nil {
+		writer.setResponseErrorReason(err)
+		setStatusTo500IfDatabaseFault(writer, err, http.StatusNotFound)
+		return
+	}
+	if thread.UserID != user.ID {
+		writer.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	threadMessages, err := handler.databaseConnection.GetThreadMessages(thread, cursor, limit)
+	if err != nil {
+		//We don't need to handle DatabaseFault since we 500 anyway
+		writer.setResponseErrorReason(err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rawRes := struct {
+		Messages   []events.MessageData `json:"messages"`
+		NextCursor string               `json:"next_cursor,omitempty"`
+	}{Messages: make([]events.MessageData, 0, len(threadMessages))}
+	for _, message := range threadMessages {
+		rawRes.Messages = append(rawRes.Messages, events.NewMessageData(message))
+	}
+	if len(threadMessages) == limit {
+		rawRes.NextCursor = strconv.Itoa(threadMessages[len(threadMessages)-1].ID)
+	}
+
+	writeJSONResponse(writer, rawRes)
+}
@@ -2,11 +2,15 @@ package web
 
 import (
 	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"path"
+	"strconv"
+	"strings"
 
 	"github.com/ollien/sms-pusher/server/db"
 	uuid "github.com/satori/go.uuid"
@@ -17,12 +21,30 @@ import (
 const (
 	uploadedFileMode = 0644
 	routeKey         = "_route"
+	sessionIDHeader  = "X-Session-ID"
+	csrfTokenHeader  = "X-CSRF-Token"
+	bearerPrefix     = "Bearer "
+	defaultPageSize  = 50
+	maxPageSize      = 200
 )
 
+const (
+	//MessagesSendScope allows a personal access token to send messages
+	MessagesSendScope = "messages:send"
+	//MessagesReadScope allows a personal access token to read messages, and the status of messages that have been sent
+	MessagesReadScope = "messages:read"
+)
+
+//validScopes holds every scope that a personal access token may be granted
+var validScopes = map[string]bool{
+	MessagesSendScope: true,
+	MessagesReadScope: true,
+}
+
 //GetSessionCookie gets the cookie named "session" from http.Cookies()
 func GetSessionCookie(req *http.Request) *http.Cookie {
 	for _, cookie := range req.Cookies() {
-		if cookie.Name == "session" {
+		if cookie.Name == sessionCookieName {
 			return cookie
 		}
 	}
@@ -30,27 +52,73 @@ func GetSessionCookie(req *http.Request) *http.Cookie {
 	return nil
 }
 
-//GetSessionUser gets the user associated with a session within a *http.Request.
-func GetSessionUser(databaseConnection db.DatabaseConnection, req *http.Request) (db.User, error) {
-	cookie := GetSessionCookie(req)
-	sessionID := req.FormValue("session_id")
-	if sessionID == "" {
-		if cookie != nil {
-			sessionID = cookie.Value
-		} else {
-			return db.User{}, errors.New("no session cookie found")
-		}
+//GetRequestSession gets the session that a *http.Request is authenticated with.
+func GetRequestSession(databaseConnection db.DatabaseConnection, req *http.Request) (db.Session, error) {
+	sessionID, _, err := getRequestSessionID(req)
+	if err != nil {
+		return db.Session{}, err
 	}
 
 	sessionUUID, err := uuid.FromString(sessionID)
 	if err != nil {
-		return db.User{}, err
+		return db.Session{}, err
 	}
 
-	session, err := databaseConnection.GetSession(sessionUUID)
+	return databaseConnection.GetSession(sessionUUID)
+}
+
+//getRequestSessionID gets the id of the session that a request is authenticated with.
+//The Android app gives its session id as the X-Session-ID header, which, unlike a form value, another site can't make a browser send. Otherwise, the id is taken from the session cookie.
+//Returns true if the id came from the session cookie, as only then could the request have been forged by another site. The id is never taken from the query string, where it could leak into logs and browser history.
+func getRequestSessionID(req *http.Request) (string, bool, error) {
+	sessionID := req.Header.Get(sessionIDHeader)
+	cookie := GetSessionCookie(req)
+	if sessionID != "" && cookie != nil {
+		//Otherwise, a user's browser could be made to act as someone else's session, without the CSRF token that the cookie would need
+		return "", false, errors.New("request has both a session cookie and a session id header")
+	} else if sessionID != "" {
+		return sessionID, false, nil
+	} else if cookie == nil {
+		return "", false, errors.New("no session cookie found")
+	}
+
+	return cookie.Value, true, nil
+}
+
+//getRequestCSRFToken gets the CSRF token that a request was sent with, given either as the X-CSRF-Token header or the csrf_token value of a form body.
+func getRequestCSRFToken(req *http.Request) string {
+	csrfToken := req.Header.Get(csrfTokenHeader)
+	if csrfToken == "" {
+		csrfToken = req.PostFormValue("csrf_token")
+	}
+
+	return csrfToken
+}
+
+//getBearerToken gets the token from a request's "Authorization: Bearer" header. Returns false if there is no such header.
+func getBearerToken(req *http.Request) (string, bool) {
+	authorization := req.Header.Get("Authorization")
+	if len(authorization) <= len(bearerPrefix) || !strings.EqualFold(authorization[:len(bearerPrefix)], bearerPrefix) {
+		return "", false
+	}
+
+	return strings.TrimSpace(authorization[len(bearerPrefix):]), true
+}
+
+//isSafeMethod returns whether or not a request with the given method may not change any state, and so needs no protection from forgery.
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+//getClientIP gets the IP address that a request came from.
+//Forwarding headers are not trusted, as they can be set by the client.
+func getClientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
 
-	//If err is not nil, there is no valid session.
-	return session.User, err
+	return host
 }
 
 //StoreFile stores an incoming file to disk, with its SHA256 as its username
@@ -90,10 +158,67 @@ func getFileName(bytes []byte) (string, error) {
 
 //setStatusTo500IfDatabaseFault writes a 500 status code if the error is a database fault. Otherwise, it writes the given status code.
 func setStatusTo500IfDatabaseFault(writer http.ResponseWriter, err error, alternateStatusCode int) {
-	if dbErr, ok := err.(db.DatabaseError); ok && dbErr.DatabaseFault {
+	if dbErr, ok := err.(*db.DatabaseError); ok && dbErr.DatabaseFault {
 		writer.WriteHeader(http.StatusInternalServerError)
 	} else {
 		writer.WriteHeader(alternateStatusCode)
 	}
 
 }
+
+//getPageParameters gets the cursor and limit form values used for paginated routes.
+//A missing cursor is returned as zero, meaning the first page. A missing limit is returned as defaultPageSize, and limits are capped at maxPageSize.
+func getPageParameters(req *http.Request) (int, int, error) {
+	cursor := 0
+	rawCursor := req.FormValue("cursor")
+	if rawCursor != "" {
+		var err error
+		cursor, err = strconv.Atoi(rawCursor)
+		if err != nil || cursor <= 0 {
+			return 0, 0, errors.New("invalid cursor")
+		}
+	}
+
+	limit := defaultPageSize
+	rawLimit := req.FormValue("limit")
+	if rawLimit != "" {
+		var err error
+		limit, err = strconv.Atoi(rawLimit)
+		if err != nil || limit <= 0 {
+			return 0, 0, errors.New("invalid limit")
+		}
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	return cursor, limit, nil
+}
+
+//writeJSONResponse marshals value and writes it to the client. If marshalling fails, a 500 is written instead.
+func writeJSONResponse(writer *LoggableResponseWriter, value interface{}) {
+	writeJSONResponseWithStatus(writer, http.StatusOK, value)
+}
+
+//writeJSONResponseWithStatus is identical to writeJSONResponse, but writes statusCode rather than a 200.
+//Headers can't be changed once the status has been written, so the status must not be written before calling this.
+func writeJSONResponseWithStatus(writer *LoggableResponseWriter, statusCode int, value interface{}) {
+	res, err := json.Marshal(value)
+	if err != nil {
+		writer.setResponseErrorReason(err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(statusCode)
+	writer.Write(res)
+}
+
+//writeCSRFTokenResponse writes the CSRF token of a session to the client, which it must send with any request that changes state and is authenticated by its session cookie.
+func writeCSRFTokenResponse(writer *LoggableResponseWriter, session db.Session) {
+	rawRes := struct {
+		CSRFToken string `json:"csrf_token"`
+	}{session.CSRFToken}
+	writeJSONResponse(writer, rawRes)
+}
@@ -1,6 +1,9 @@
 package web
 
 import (
+	"bufio"
+	"errors"
+	"net"
 	"net/http"
 
 	"github.com/sirupsen/logrus"
@@ -56,6 +59,27 @@ func (writer *LoggableResponseWriter) WriteHeader(statusCode int) {
 	}
 }
 
+//Hijack allows LoggableResponseWriter to implement http.Hijacker, given that the wrapped http.ResponseWriter does.
+//Once hijacked, the status code is recorded as 101, as hijacking is only done to switch protocols.
+func (writer *LoggableResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := writer.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("wrapped ResponseWriter does not implement http.Hijacker")
+	}
+
+	writer.headersWritten = true
+	writer.statusCode = http.StatusSwitchingProtocols
+
+	return hijacker.Hijack()
+}
+
+//Flush allows LoggableResponseWriter to implement http.Flusher. If the wrapped http.ResponseWriter is not an http.Flusher, this does nothing.
+func (writer *LoggableResponseWriter) Flush() {
+	if flusher, ok := writer.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
 func (writer *LoggableResponseWriter) setResponseReason(reason string) {
 	writer.responseReason = reason
 }
@@ -0,0 +1,119 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ollien/sms-pusher/server/db"
+	"github.com/ollien/sms-pusher/server/events"
+)
+
+const (
+	//eventStreamKeepaliveInterval is how often a comment is sent on an idle event stream, to prevent proxies from closing it
+	eventStreamKeepaliveInterval = 15 * time.Second
+	//maxReplayedEvents is the maximum number of stored messages that will be sent to a client resuming with Last-Event-ID
+	maxReplayedEvents = 500
+)
+
+//eventStream pushes the events from a single subscription to a client as Server-Sent Events
+type eventStream struct {
+	writer       *LoggableResponseWriter
+	req          *http.Request
+	subscription *events.Subscription
+	logger       routeLogger
+	//lastMessageID is the id of the last stored message that was sent to the client. Used to avoid sending a message twice when live events overlap with replayed ones.
+	lastMessageID int
+}
+
+func newEventStream(writer *LoggableResponseWriter, req *http.Request, subscription *events.Subscription, logger routeLogger) *eventStream {
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	//Prevents nginx from buffering the stream
+	writer.Header().Set("X-Accel-Buffering", "no")
+
+	return &eventStream{
+		writer:       writer,
+		req:          req,
+		subscription: subscription,
+		logger:       logger,
+	}
+}
+
+//replay sends stored messages to the client as if they had just come in
+func (stream *eventStream) replay(messages []db.Message) {
+	for _, message := range messages {
+		err := stream.send(events.NewIncomingMessageEvent(message))
+		if err != nil {
+			stream.logger.log(stream.req).Debug(err)
+			return
+		}
+	}
+}
+
+//run pushes events to the client until either the client disconnects, or the subscription is closed.
+func (stream *eventStream) run() {
+	//Make sure the headers go out even if there is nothing to replay, so the client knows it's connected.
+	stream.writer.WriteHeader(http.StatusOK)
+	stream.writer.Flush()
+
+	keepaliveTicker := time.NewTicker(eventStreamKeepaliveInterval)
+	defer keepaliveTicker.Stop()
+	for {
+		var err error
+		select {
+		case <-stream.req.Context().Done():
+			return
+		case event, ok := <-stream.subscription.Events():
+			if !ok {
+				//The hub has dropped us. The client can reconnect with Last-Event-ID to catch up.
+				return
+			}
+			err = stream.send(event)
+		case <-keepaliveTicker.C:
+			_, err = fmt.Fprint(stream.writer, ": keepalive\n\n")
+			stream.writer.Flush()
+		}
+
+		if err != nil {
+			stream.logger.log(stream.req).Debug(err)
+			return
+		}
+	}
+}
+
+//send writes a single event to the client
+func (stream *eventStream) send(event events.Event) error {
+	if event.Type == events.IncomingMessageType {
+		messageID, err := strconv.Atoi(event.ID)
+		if err == nil && messageID <= stream.lastMessageID {
+			//Already sent during replay
+			return nil
+		} else if err == nil {
+			stream.lastMessageID = messageID
+		}
+	}
+
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		return err
+	}
+
+	if event.ID != "" {
+		_, err = fmt.Fprintf(stream.writer, "id: %s\n", event.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = fmt.Fprintf(stream.writer, "event: %s\ndata: %s\n\n", event.Type, data)
+	if err != nil {
+		return err
+	}
+
+	stream.writer.Flush()
+
+	return nil
+}
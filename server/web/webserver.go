@@ -6,7 +6,8 @@ import (
 	"github.com/julienschmidt/httprouter"
 	"github.com/ollien/sms-pusher/server/config"
 	"github.com/ollien/sms-pusher/server/db"
-	"github.com/ollien/sms-pusher/server/firebasexmpp"
+	"github.com/ollien/sms-pusher/server/events"
+	"github.com/ollien/sms-pusher/server/phonenumber"
 	"github.com/sirupsen/logrus"
 )
 
@@ -38,15 +39,29 @@ type loggableHandlerFunction = func(*LoggableResponseWriter, *http.Request, http
 type handlerFunction = func(http.ResponseWriter, *http.Request, httprouter.Params)
 
 //NewWebserver creats a new Webserver with httpServer being set to a new http.Server
-func NewWebserver(listenAddr string, databaseConnection db.DatabaseConnection, sendChannel chan<- firebasexmpp.DownstreamPayload, logger *logrus.Logger) (Webserver, error) {
+//outboxChannel must be notified whenever a message is added to the outbox.
+func NewWebserver(listenAddr string, databaseConnection db.DatabaseConnection, outboxChannel chan<- struct{}, eventHub *events.Hub, logger *logrus.Logger) (Webserver, error) {
 	config, err := config.GetConfig()
 	if err != nil {
 		return Webserver{}, err
 	}
 
+	normalizer, err := phonenumber.NewNormalizer(config.Phone.DefaultRegion)
+	if err != nil {
+		return Webserver{}, err
+	}
+
+	cookieSettings, err := newCookieSettings(config.Web.Cookie)
+	if err != nil {
+		return Webserver{}, err
+	}
+
 	routeHandler := RouteHandler{
 		databaseConnection: databaseConnection,
-		sendChannel:        sendChannel,
+		outboxChannel:      outboxChannel,
+		eventHub:           eventHub,
+		normalizer:         normalizer,
+		cookieSettings:     cookieSettings,
 		logger:             newRouteLogger(logger),
 	}
 	router := newRouter()
@@ -65,33 +80,54 @@ func NewWebserver(listenAddr string, databaseConnection db.DatabaseConnection, s
 	return webserver, nil
 }
 
+//initHandlers declares every route, along with how its requests must be authenticated
 func (serv *Webserver) initHandlers() {
 	router := serv.Server.Handler.(*hookedRouter)
-	router.GET("/", serv.wrapHandlerFunction(serv.routeHandler.index))
-	router.POST("/register", serv.wrapHandlerFunction(serv.routeHandler.register))
-	router.POST("/authenticate", serv.wrapHandlerFunction(serv.routeHandler.authenticate))
-	router.POST("/register_device", serv.wrapHandlerFunction(serv.routeHandler.registerDevice))
-	router.POST("/set_fcm_id", serv.wrapHandlerFunction(serv.routeHandler.setFCMID))
-	router.POST("/send_message", serv.wrapHandlerFunction(serv.routeHandler.sendMessage))
-	router.POST("/upload_mms_file", serv.wrapHandlerFunctionWithLimit(serv.routeHandler.uploadMMSFile, maxFileSize))
+	router.GET("/", serv.wrapHandlerFunction(serv.routeHandler.index, publicRoute))
+	router.POST("/register", serv.wrapHandlerFunction(serv.routeHandler.register, sessionRoute))
+	//authenticate checks for an existing session itself, as it must also work without one
+	router.POST("/authenticate", serv.wrapHandlerFunction(serv.routeHandler.authenticate, publicRoute))
+	router.GET("/csrf_token", serv.wrapHandlerFunction(serv.routeHandler.getCSRFToken, sessionRoute))
+	router.POST("/logout", serv.wrapHandlerFunction(serv.routeHandler.logout, sessionRoute))
+	router.GET("/sessions", serv.wrapHandlerFunction(serv.routeHandler.getSessions, sessionRoute))
+	router.DELETE("/sessions/:id", serv.wrapHandlerFunction(serv.routeHandler.deleteSession, sessionRoute))
+	router.POST("/tokens", serv.wrapHandlerFunction(serv.routeHandler.createAccessToken, sessionRoute))
+	router.GET("/tokens", serv.wrapHandlerFunction(serv.routeHandler.getAccessTokens, sessionRoute))
+	router.DELETE("/tokens/:id", serv.wrapHandlerFunction(serv.routeHandler.deleteAccessToken, sessionRoute))
+	router.POST("/register_device", serv.wrapHandlerFunction(serv.routeHandler.registerDevice, sessionRoute))
+	router.POST("/devices/:id/token", serv.wrapHandlerFunction(serv.routeHandler.issueDeviceToken, sessionRoute))
+	router.DELETE("/devices/:id/token", serv.wrapHandlerFunction(serv.routeHandler.revokeDeviceToken, sessionRoute))
+	router.POST("/set_fcm_id", serv.wrapHandlerFunction(serv.routeHandler.setFCMID, deviceRoute))
+	router.POST("/send_message", serv.wrapHandlerFunction(serv.routeHandler.sendMessage, scopedRoute(MessagesSendScope).withDevice()))
+	router.GET("/message_status/:message_id", serv.wrapHandlerFunction(serv.routeHandler.getMessageStatus, scopedRoute(MessagesReadScope)))
+	router.POST("/upload_mms_file", serv.wrapHandlerFunctionWithLimit(serv.routeHandler.uploadMMSFile, deviceRoute, maxFileSize))
+	router.GET("/websocket", serv.wrapHandlerFunction(serv.routeHandler.openWebsocket, sessionRoute))
+	router.GET("/events", serv.wrapHandlerFunction(serv.routeHandler.streamEvents, sessionRoute))
+	router.GET("/threads", serv.wrapHandlerFunction(serv.routeHandler.getThreads, scopedRoute(MessagesReadScope)))
+	router.GET("/threads/:id/messages", serv.wrapHandlerFunction(serv.routeHandler.getThreadMessages, scopedRoute(MessagesReadScope)))
 }
 
-//wrapHandlerFunction allows us to enforce a file size limit
-//Though we could theoretically put this in ServeHTTP, this allows us to set different sizes for different routes after httprouter has taken care of the route handling for us.
-func (serv *Webserver) wrapHandlerFunction(handler loggableHandlerFunction) handlerFunction {
-	return serv.wrapHandlerFunctionWithLimit(handler, maxRequestSize)
+//wrapHandlerFunction allows us to enforce a file size limit, and to authenticate requests as the route's authPolicy requires
+//Though we could theoretically put this in ServeHTTP, this allows us to set different sizes and policies for different routes after httprouter has taken care of the route handling for us.
+func (serv *Webserver) wrapHandlerFunction(handler loggableHandlerFunction, policy authPolicy) handlerFunction {
+	return serv.wrapHandlerFunctionWithLimit(handler, policy, maxRequestSize)
 }
 
 //wrapHandlerFunctionWithLimit is the same as wrapHandlerFunction but allows us to set a size limit on the request
-func (serv *Webserver) wrapHandlerFunctionWithLimit(handler loggableHandlerFunction, sizeLimit int64) handlerFunction {
+func (serv *Webserver) wrapHandlerFunctionWithLimit(handler loggableHandlerFunction, policy authPolicy, sizeLimit int64) handlerFunction {
 	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
 		//Due to our wrapping within hookedRouter.ServeHTTP, we can always expect a LoggableResponseWriter
 		loggableWriter := writer.(*LoggableResponseWriter)
 		//Enforce a max file size
 		req.Body = http.MaxBytesReader(loggableWriter, req.Body, sizeLimit)
-		//Pass our request to the handler only if we have a valid form.
-		if serv.checkFormValidity(loggableWriter, req) {
-			handler(loggableWriter, req, params)
+		//Pass our request to the handler only if we have a valid form, and it is authenticated.
+		if !serv.checkFormValidity(loggableWriter, req) {
+			return
+		}
+
+		authedReq, ok := serv.authenticateRequest(loggableWriter, req, policy)
+		if ok {
+			handler(loggableWriter, authedReq, params)
 		}
 	}
 }
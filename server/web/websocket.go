@@ -0,0 +1,92 @@
+package web
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/ollien/sms-pusher/server/events"
+)
+
+const (
+	//websocketWriteTimeout is the maximum time a single write to a websocket may take
+	websocketWriteTimeout = 10 * time.Second
+	//websocketPongTimeout is the maximum time we will wait between pongs before considering the client gone
+	websocketPongTimeout = 60 * time.Second
+	//websocketPingInterval must be less than websocketPongTimeout so that the client has time to respond
+	websocketPingInterval = (websocketPongTimeout * 9) / 10
+)
+
+//The default CheckOrigin rejects cross-origin upgrades, which is what we want, given that we authenticate by cookie.
+var websocketUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+//websocketSession pushes the events from a single subscription to a single websocket connection
+type websocketSession struct {
+	conn         *websocket.Conn
+	subscription *events.Subscription
+	logger       routeLogger
+}
+
+func newWebsocketSession(conn *websocket.Conn, subscription *events.Subscription, logger routeLogger) websocketSession {
+	return websocketSession{
+		conn:         conn,
+		subscription: subscription,
+		logger:       logger,
+	}
+}
+
+//run pushes events to the client until either the client disconnects, or the subscription is closed.
+func (session websocketSession) run(req *http.Request) {
+	defer session.conn.Close()
+	go session.readUntilClosed()
+
+	pingTicker := time.NewTicker(websocketPingInterval)
+	defer pingTicker.Stop()
+	for {
+		select {
+		case event, ok := <-session.subscription.Events():
+			session.conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+			if !ok {
+				//The hub has dropped us, or the client went away. Either way, there's nothing more to send.
+				session.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+				return
+			}
+
+			err := session.conn.WriteJSON(event)
+			if err != nil {
+				session.logger.log(req).Debug(err)
+				session.subscription.Close()
+				return
+			}
+		case <-pingTicker.C:
+			session.conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+			err := session.conn.WriteMessage(websocket.PingMessage, nil)
+			if err != nil {
+				session.logger.log(req).Debug(err)
+				session.subscription.Close()
+				return
+			}
+		}
+	}
+}
+
+//readUntilClosed reads from the client, which is necessary for processing pongs and close messages, until the connection is closed.
+//The client has nothing to tell us, so anything it sends is discarded.
+func (session websocketSession) readUntilClosed() {
+	session.conn.SetReadLimit(maxRequestSize)
+	session.conn.SetReadDeadline(time.Now().Add(websocketPongTimeout))
+	session.conn.SetPongHandler(func(string) error {
+		return session.conn.SetReadDeadline(time.Now().Add(websocketPongTimeout))
+	})
+
+	for {
+		_, _, err := session.conn.NextReader()
+		if err != nil {
+			session.subscription.Close()
+			return
+		}
+	}
+}
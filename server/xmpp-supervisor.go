@@ -1,6 +1,12 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
 	"github.com/ollien/sms-pusher/server/firebasexmpp"
 	"github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
@@ -8,14 +14,40 @@ import (
 
 const clientErrorFormat = "Client %s: %s"
 
+//errSupervisorShutDown is returned when a client is spawned after the supervisor has been shut down
+var errSupervisorShutDown = errors.New("xmpp supervisor has been shut down")
+
+//routeRetryInterval is how long to wait for a client to take a payload before another client is picked for it, and how long to wait before trying again when no client can take one.
+const routeRetryInterval = 100 * time.Millisecond
+
+//drainGracePeriod is how long a draining client is given for FCM to respond to the payloads it has sent, before they are handed to another client.
+const drainGracePeriod = 10 * time.Second
+
+const (
+	//reconnectBaseDelay is the longest wait before the second attempt to replace a lost connection. It doubles with every failed attempt after that.
+	reconnectBaseDelay = time.Second
+	maxReconnectDelay  = 5 * time.Minute
+)
+
 //XMPPSupervisor supervises all Firebase XMPP connections
+//It owns the dispatch of downstream messages: each payload on sendChannel is routed to the client best able to send it.
+//It also keeps at least minClients connections that aren't draining open, replacing any that drain or drop.
 type XMPPSupervisor struct {
-	clients       map[string]ClientContainer
-	logger        *logrus.Logger
-	recvChannel   chan firebasexmpp.UpstreamMessage
-	sendChannel   chan firebasexmpp.DownstreamPayload
-	signalChannel chan firebasexmpp.Signal
-	spawnChannel  chan ClientContainer
+	clients    map[string]ClientContainer
+	clientsMux sync.RWMutex
+	minClients int
+	//pendingSpawns is the number of clients being spawned to replace others. It is guarded by clientsMux.
+	pendingSpawns int
+	//shutDown is set once Shutdown is called, after which no clients are spawned. It is guarded by clientsMux.
+	shutDown        bool
+	logger          *logrus.Logger
+	recvChannel     chan firebasexmpp.UpstreamMessage
+	sendChannel     chan firebasexmpp.DownstreamPayload
+	deliveryChannel chan firebasexmpp.DeliveryUpdate
+	retryScheduler  *firebasexmpp.RetryScheduler
+	upstreamCache   *firebasexmpp.UpstreamCache
+	dial            firebasexmpp.Dialer
+	signalChannel   chan firebasexmpp.Signal
 }
 
 //ClientContainer holds a client and its channels
@@ -23,77 +55,306 @@ type ClientContainer struct {
 	client       firebasexmpp.FirebaseClient
 	logger       *logrus.Logger
 	errorChannel chan firebasexmpp.ClientError
+	//sendChannel is the client's own send channel, which the supervisor routes payloads to
+	sendChannel chan firebasexmpp.DownstreamPayload
+	//draining is set once FCM has told the client's connection to drain. Payloads are never routed to a draining client.
+	draining bool
 }
 
-//NewXMPPSupervisor creates a new XMPPSupervisor and starts the necessary handlers, given the channels to receive messages from firebase, and the channels to send messages to firebase.
-func NewXMPPSupervisor(recvChannel chan firebasexmpp.UpstreamMessage, sendChannel chan firebasexmpp.DownstreamPayload, logger *logrus.Logger) XMPPSupervisor {
-	supervisor := XMPPSupervisor{
-		clients:       make(map[string]ClientContainer),
-		logger:        logger,
-		signalChannel: make(chan firebasexmpp.Signal),
-		recvChannel:   recvChannel,
-		sendChannel:   sendChannel,
-		spawnChannel:  make(chan ClientContainer),
+//NewXMPPSupervisor creates a new XMPPSupervisor and starts the necessary handlers, given the channels to receive messages from firebase, the channels to send messages to firebase, and the channel to report the delivery status of those messages on.
+//sendChannel may be nil if downstream messages are sent some other way. Once started, at least minClients connections are kept open.
+func NewXMPPSupervisor(recvChannel chan firebasexmpp.UpstreamMessage, sendChannel chan firebasexmpp.DownstreamPayload, deliveryChannel chan firebasexmpp.DeliveryUpdate, minClients int, logger *logrus.Logger) *XMPPSupervisor {
+	supervisor := &XMPPSupervisor{
+		clients:         make(map[string]ClientContainer),
+		minClients:      minClients,
+		logger:          logger,
+		signalChannel:   make(chan firebasexmpp.Signal),
+		recvChannel:     recvChannel,
+		sendChannel:     sendChannel,
+		deliveryChannel: deliveryChannel,
+		retryScheduler:  firebasexmpp.NewRetryScheduler(sendChannel),
+		upstreamCache:   firebasexmpp.NewUpstreamCache(firebasexmpp.DefaultUpstreamCacheSize),
+		dial:            firebasexmpp.DialXMPP,
 	}
 
 	//Launch handlers
-	go supervisor.listenAndSpawn()
 	go supervisor.listenForSignal()
+	if sendChannel != nil {
+		go supervisor.dispatch()
+	}
 
 	return supervisor
 }
 
-//SpawnClient spawns a new FirebaseClient
-func (supervisor *XMPPSupervisor) SpawnClient() error {
-	container := ClientContainer{
-		logger:       supervisor.logger,
-		errorChannel: make(chan firebasexmpp.ClientError),
+//Start spawns the minimum number of clients. If any can't be spawned, an error is returned; connections that are lost after this are replaced automatically.
+func (supervisor *XMPPSupervisor) Start() error {
+	for i := 0; i < supervisor.minClients; i++ {
+		err := supervisor.SpawnClient()
+		if err != nil {
+			return err
+		}
 	}
 
-	return supervisor.spawnClientFromContainer(container)
+	return nil
 }
 
-func (supervisor *XMPPSupervisor) spawnClientFromContainer(container ClientContainer) error {
-	//Because errors can happen during creation, we need to start the listening for errors routine now.
+//SpawnClient spawns a new FirebaseClient
+func (supervisor *XMPPSupervisor) SpawnClient() error {
 	rawClientID, err := uuid.NewV4()
 	if err != nil {
 		return err
 	}
 	clientID := rawClientID.String()
 
-	firebaseClient, err := firebasexmpp.NewFirebaseClient(clientID, supervisor.recvChannel, supervisor.sendChannel, supervisor.signalChannel, container.errorChannel)
+	transport, err := supervisor.dial()
 	if err != nil {
 		return err
 	}
 
-	container.client = firebaseClient
-	supervisor.clients[container.client.ClientID] = container
+	container := ClientContainer{
+		logger:       supervisor.logger,
+		errorChannel: make(chan firebasexmpp.ClientError),
+		sendChannel:  make(chan firebasexmpp.DownstreamPayload),
+	}
+	container.client = firebasexmpp.NewFirebaseClient(clientID, transport, supervisor.recvChannel, container.sendChannel, supervisor.deliveryChannel, supervisor.retryScheduler, supervisor.upstreamCache, supervisor.signalChannel, container.errorChannel)
+	supervisor.clientsMux.Lock()
+	//The supervisor may have been shut down while we were dialing
+	if supervisor.shutDown {
+		supervisor.clientsMux.Unlock()
+		transport.Close()
+		return errSupervisorShutDown
+	}
+	supervisor.clients[clientID] = container
+	supervisor.clientsMux.Unlock()
+
 	go container.listenForError()
-	go container.client.StartRecv()
-	go container.client.ListenForSend()
+	go supervisor.runClient(container)
 
 	return nil
 }
 
-//listenAndSpawns listens on supervisor.spawnChannel and spawns clients as necessary
-//Exits when supervisor.spawnChannel is closed
-func (supervisor *XMPPSupervisor) listenAndSpawn() {
-	for container := range supervisor.spawnChannel {
-		supervisor.spawnClientFromContainer(container)
+//runClient runs a client until its connection closes, and then cleans up after it
+func (supervisor *XMPPSupervisor) runClient(container ClientContainer) {
+	var clientRoutines sync.WaitGroup
+	clientRoutines.Add(1)
+	go func() {
+		defer clientRoutines.Done()
+		container.client.StartRecv()
+	}()
+
+	//Without a send channel, clients are only used to receive upstream messages
+	if supervisor.sendChannel != nil {
+		clientRoutines.Add(1)
+		go func() {
+			defer clientRoutines.Done()
+			container.client.ListenForSend()
+		}()
 	}
+
+	//Nothing can report an error once the client's routines have finished
+	clientRoutines.Wait()
+	close(container.errorChannel)
 }
 
 //listenForSignal listens on supervisor.signalChannel and passes the signal aloong to the appropriate channels
-//Exists when supervisor.spawnChannel closes
+//Exits when supervisor.signalChannel closes
 func (supervisor *XMPPSupervisor) listenForSignal() {
 	for signal := range supervisor.signalChannel {
+		clientID := signal.Client.ClientID
+		supervisor.clientsMux.Lock()
 		if signal.Type == firebasexmpp.ConnectionDrainingSignal {
-			supervisor.spawnChannel <- supervisor.clients[signal.Client.ClientID]
+			container, ok := supervisor.clients[clientID]
+			if ok && !container.draining {
+				container.draining = true
+				container.client.StopSending()
+				supervisor.clients[clientID] = container
+				go supervisor.drain(container)
+			}
 		} else {
-			clientID := signal.Client.ClientID
 			delete(supervisor.clients, clientID)
 		}
+
+		supervisor.replaceLostClients()
+		supervisor.clientsMux.Unlock()
+	}
+}
+
+//drain hands the work of a draining client over to the rest of the pool, and then closes it.
+//FCM is given drainGracePeriod to respond to what the client has already sent; anything it hasn't responded to by then is sent again by another client.
+//The client must have already been marked as draining, and its replacement spawned.
+func (supervisor *XMPPSupervisor) drain(container ClientContainer) {
+	var unresponded []firebasexmpp.DownstreamPayload
+	if !container.client.WaitForInFlight(drainGracePeriod) {
+		unresponded = container.client.TakeInFlight()
+	}
+
+	//Closing the client removes it from the pool once its receive loop ends
+	err := container.client.Close()
+	if err != nil {
+		supervisor.logger.Warnf(clientErrorFormat, container.client.ClientID, err)
+	}
+
+	if len(unresponded) > 0 {
+		supervisor.logger.Warnf("Client %s: moving %d payloads without a response to another client", container.client.ClientID, len(unresponded))
+	}
+	for _, payload := range unresponded {
+		supervisor.route(payload)
+	}
+}
+
+//replaceLostClients starts spawning clients until there are minClients that aren't draining. clientsMux must be held.
+//Once the supervisor has been shut down, nothing is replaced.
+func (supervisor *XMPPSupervisor) replaceLostClients() {
+	if supervisor.shutDown {
+		return
+	}
+
+	liveClients := supervisor.pendingSpawns
+	for _, container := range supervisor.clients {
+		if !container.draining {
+			liveClients++
+		}
+	}
+
+	for ; liveClients < supervisor.minClients; liveClients++ {
+		supervisor.pendingSpawns++
+		go supervisor.respawn()
+	}
+}
+
+//respawn spawns a client to replace one that was lost, retrying with exponential backoff until it succeeds
+func (supervisor *XMPPSupervisor) respawn() {
+	for attempt := 0; ; attempt++ {
+		//The first attempt is immediate, as a draining connection should be replaced before FCM closes it
+		time.Sleep(getReconnectDelay(attempt))
+		err := supervisor.SpawnClient()
+		if err == nil || err == errSupervisorShutDown {
+			break
+		}
+
+		supervisor.logger.Errorf("Could not replace XMPP connection (attempt %d): %s", attempt+1, err)
+	}
+
+	supervisor.clientsMux.Lock()
+	supervisor.pendingSpawns--
+	supervisor.clientsMux.Unlock()
+}
+
+//Shutdown stops every client from sending, waits for FCM to respond to what they have already sent, and then closes them. No clients are spawned after this is called.
+//Payloads that FCM hasn't responded to by the time ctx expires are abandoned; they remain in the outbox, and are sent again when the server next starts.
+func (supervisor *XMPPSupervisor) Shutdown(ctx context.Context) error {
+	supervisor.clientsMux.Lock()
+	supervisor.shutDown = true
+	containers := make([]ClientContainer, 0, len(supervisor.clients))
+	for _, container := range supervisor.clients {
+		container.client.StopSending()
+		containers = append(containers, container)
+	}
+	supervisor.clientsMux.Unlock()
+
+	deadline, hasDeadline := ctx.Deadline()
+	if !hasDeadline {
+		deadline = time.Now().Add(drainGracePeriod)
+	}
+
+	var shutdownErr error
+	for _, container := range containers {
+		if !container.client.WaitForInFlight(time.Until(deadline)) {
+			supervisor.logger.Warnf("Client %s: closing with %d payloads without a response", container.client.ClientID, container.client.InFlightCount())
+		}
+
+		err := container.client.Close()
+		if err != nil {
+			supervisor.logger.Warnf(clientErrorFormat, container.client.ClientID, err)
+			if shutdownErr == nil {
+				shutdownErr = err
+			}
+		}
+	}
+
+	return shutdownErr
+}
+
+//getReconnectDelay gets how long to wait before the given attempt to replace a connection. The delay is jittered between half and all of the exponential backoff, so that connections lost together aren't all replaced at once.
+func getReconnectDelay(attempt int) time.Duration {
+	if attempt == 0 {
+		return 0
+	}
+
+	backoff := maxReconnectDelay
+	//Past this many attempts, the backoff would overflow or exceed the max regardless
+	if attempt < 20 {
+		backoff = reconnectBaseDelay * time.Duration(1<<uint(attempt-1))
+	}
+	if backoff > maxReconnectDelay {
+		backoff = maxReconnectDelay
+	}
+
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+//dispatch routes every payload on sendChannel to a client
+//Exits when supervisor.sendChannel closes
+func (supervisor *XMPPSupervisor) dispatch() {
+	for payload := range supervisor.sendChannel {
+		supervisor.route(payload)
+	}
+}
+
+//route gives a payload to the client with the fewest messages in flight, that isn't draining and has room for another message.
+//Blocks until a client takes the payload.
+func (supervisor *XMPPSupervisor) route(payload firebasexmpp.DownstreamPayload) {
+	for {
+		container, ok := supervisor.pickClient()
+		if !ok && supervisor.isShutDown() {
+			//No client will ever take the payload. It remains in the outbox, so it will be sent when the server next starts.
+			return
+		} else if !ok {
+			time.Sleep(routeRetryInterval)
+			continue
+		}
+
+		//The client may fill up or start draining between being picked and taking the payload, in which case another must be picked.
+		select {
+		case container.sendChannel <- payload:
+			return
+		case <-time.After(routeRetryInterval):
+		}
+	}
+}
+
+//isShutDown returns whether or not Shutdown has been called
+func (supervisor *XMPPSupervisor) isShutDown() bool {
+	supervisor.clientsMux.RLock()
+	defer supervisor.clientsMux.RUnlock()
+
+	return supervisor.shutDown
+}
+
+//pickClient picks the client that a payload should be routed to. Returns false if no client can currently take a payload.
+func (supervisor *XMPPSupervisor) pickClient() (ClientContainer, bool) {
+	supervisor.clientsMux.RLock()
+	defer supervisor.clientsMux.RUnlock()
+
+	var picked ClientContainer
+	found := false
+	//Clients stop sending once the supervisor is shut down
+	if supervisor.shutDown {
+		return picked, found
+	}
+
+	for _, container := range supervisor.clients {
+		if container.draining || !container.client.HasCapacity() {
+			continue
+		}
+
+		if !found || container.client.InFlightCount() < picked.client.InFlightCount() {
+			picked = container
+			found = true
+		}
 	}
+
+	return picked, found
 }
 
 //listenForError listens on a client's error channel and logs it to the logrus logger.